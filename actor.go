@@ -0,0 +1,294 @@
+package device
+
+import (
+	"errors"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 每个下位机注册后都有一个端口线程 它独占该下位机的状态 包括发送缓存 接收缓存 编解码器 能力声明 协商结果 发送窗口和重放窗口
+ 其它线程不直接读写这些状态 而是通过call把要做的事交给端口线程执行并等待其完成 所以这些状态不需要加锁
+ 端口线程同时负责处理读取线程读到的数据 轮转发送数据帧 确认超时重发 以及定时清理缓冲区 这些事情依次进行 不会同时发生
+ 在端口线程中执行的函数不能再调用call 其它线程也不能在持有app.mu时调用call
+ 投递给模块的讯息由投递线程按顺序送出 模块没有及时取走讯息时端口线程不会阻塞 直到投递队列已满
+ app.mu只保护注册表和应用级的配置 也就是COM和模块到下位机和消息通道的映射 以及端口的传输 端口线程中可以短暂持有
+*/
+
+// 投递队列的长度
+const deliveryQueueLen = 64
+
+// ErrPortStopped 端口线程已经退出 下位机已经被移除或者SerialApp已经关闭
+var ErrPortStopped = errors.New("PortStopped")
+
+// ErrPortNotOpen 下位机的端口从来没有打开过 例如自动初始化时打开端口失败
+var ErrPortNotOpen = errors.New("PortNotOpen")
+
+// 等待投递给模块的讯息
+type delivery struct {
+	// 模块的通道
+	channel chan *SerialMessage
+	// 讯息
+	message *SerialMessage
+}
+
+// 端口线程 独占一个下位机的状态
+type portActor struct {
+	// App
+	app *SerialApp
+	// 下位机
+	device *SerialDevice
+	// 交给端口线程执行的函数
+	calls chan func()
+	// 等待投递给模块的讯息
+	deliveries chan delivery
+	// 端口线程退出时关闭
+	done chan struct{}
+	// 以下只在端口线程中读写
+	// 是否已经被要求退出
+	isStopped bool
+	// 是否轮转发送数据帧
+	isSending bool
+	// 读取线程读到的数据 没有在监听时为nil
+	reads chan []byte
+	// 读取线程的错误
+	readErr chan error
+	// 通知读取线程退出
+	readDone chan struct{}
+	// 监听结束时返回结果的管道 可以为nil
+	listenResult chan error
+	// 从字节流中切分数据帧
+	receiver *frameReceiver
+}
+
+// 为刚注册的下位机启动端口线程和投递线程 SerialApp已经关闭时不启动 之后的call都返回ErrPortStopped
+// 传入：下位机
+// 传出：端口线程
+func (app *SerialApp) startActor(device *SerialDevice) *portActor {
+	actor := &portActor{
+		app:        app,
+		device:     device,
+		calls:      make(chan func()),
+		deliveries: make(chan delivery, deliveryQueueLen),
+		done:       make(chan struct{}),
+	}
+	if !app.goFunc(actor.run) {
+		close(actor.done)
+		return actor
+	}
+	app.goFunc(actor.deliver)
+	return actor
+}
+
+// 在端口线程中执行一个函数并等待其完成
+// 传入：函数
+// 传出：函数返回的错误 端口线程已经退出时返回ErrPortStopped
+func (actor *portActor) call(f func() error) error {
+	finished := make(chan error, 1)
+	select {
+	case actor.calls <- func() { finished <- f() }:
+	case <-actor.done:
+		return util.NewError(_const.TrivialException, _const.Device, ErrPortStopped)
+	}
+	return <-finished
+}
+
+// 让端口线程退出 正在进行的监听随之结束
+// 传入：无
+// 传出：无
+func (actor *portActor) stop() {
+	_ = actor.call(func() error {
+		actor.isStopped = true
+		return nil
+	})
+}
+
+// 端口线程
+// 没有需要发送的数据帧时阻塞 直到有交给它的函数 读到的数据 确认超时 定时清理或者SerialApp关闭
+// 发出了数据帧时不阻塞 在两轮发送之间处理已经到达的事件 以免确认和读到的数据等待整个数据报发完
+// 传入：无
+// 传出：无
+func (actor *portActor) run() {
+	defer close(actor.done)
+	// 下位机被移除或者SerialApp关闭后 发送缓存中的数据报不会再有结果
+	defer actor.device.sendBuffer.removeAllSendData(util.NewError(_const.TrivialException, _const.Device, ErrPortStopped))
+	defer actor.stopListening(nil)
+	ready := make(chan time.Time)
+	close(ready)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for !actor.isStopped {
+		// 只在监听或者发送时定时清理缓冲区
+		isActive := actor.isSending || actor.reads != nil
+		if isActive && ticker == nil {
+			ticker = time.NewTicker(expiryInterval(min(actor.app.RevBufferWaitTimeOut, actor.app.SendBufferWaitTimeOut)))
+		} else if !isActive && ticker != nil {
+			ticker.Stop()
+			ticker = nil
+		}
+		var tick <-chan time.Time
+		if ticker != nil {
+			tick = ticker.C
+		}
+		var timeout <-chan time.Time
+		if actor.isSending {
+			isSent, wakeTime := actor.sendRound()
+			if isSent {
+				timeout = ready
+			} else if wakeTime != 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Duration(wakeTime-time.Now().UnixMilli()) * time.Millisecond)
+				timeout = timer.C
+			}
+		}
+		select {
+		case <-actor.app.ctx.Done():
+			return
+		case f := <-actor.calls:
+			f()
+		case data := <-actor.reads:
+			actor.receiver.push(data)
+			actor.app.handleReceivedFrames(actor.device, actor.receiver)
+		case err := <-actor.readErr:
+			actor.stopListening(err)
+		case <-tick:
+			actor.device.revBuffer.clean()
+		case <-timeout:
+		}
+	}
+}
+
+// 发送一轮数据帧 写入出错时发布事件并停止发送 无法编码的数据报单独放弃
+// 传入：无
+// 传出：是否发出了数据帧，下一次需要检查确认超时的时间 毫秒（为0时不需要）
+func (actor *portActor) sendRound() (bool, int64) {
+	frames, wakeTime := actor.device.sendBuffer.nextRound()
+	for _, frame := range frames {
+		// 同一轮中已经被放弃的数据报
+		if actor.device.sendBuffer.sendBuffer[frame.send.bufferID] != frame.send {
+			continue
+		}
+		// 发送数据帧 无法编码时只放弃这个数据报 例如重新协商后帧头放不下它的字段
+		err := actor.app.sending(actor.device, frame.send, frame.frameID, frame.data)
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) {
+			actor.device.sendBuffer.failSendData(frame.send, frame.frameID, EventSendFailed, err)
+			continue
+		}
+		if err != nil {
+			actor.isSending = false
+			event := Event{Kind: EventWriteFailed, COM: actor.device.COM, HasFrame: true, BufferID: frame.send.bufferID, FrameID: frame.frameID}
+			if frame.send.message != nil {
+				event.ModuleID = frame.send.message.TargetModuleID
+			}
+			actor.app.publish(event, _const.CommonException, err)
+			frame.send.finish(err)
+			return false, 0
+		}
+	}
+	return len(frames) > 0, wakeTime
+}
+
+// 开始监听 已经在监听时先结束之前的监听 端口没有打开过时不开始监听
+// 传入：监听结束时返回结果的管道 可以为nil
+// 传出：错误
+func (actor *portActor) startListening(result chan error) error {
+	// 读取线程只读取开始监听时的端口 端口被重新打开后由新的读取线程读取
+	portIO := actor.app.getPortIO(actor.device)
+	if portIO == nil {
+		return util.NewError(_const.TrivialException, _const.Device, ErrPortNotOpen)
+	}
+	actor.stopListening(nil)
+	reads := make(chan []byte, 16)
+	readErr := make(chan error, 1)
+	readDone := make(chan struct{})
+	actor.reads = reads
+	actor.readErr = readErr
+	actor.readDone = readDone
+	actor.listenResult = result
+	actor.receiver = initFrameReceiver(actor.device.codec, actor.device.stats)
+	if !actor.app.goFunc(func() { actor.app.readPort(portIO, reads, readErr, readDone) }) {
+		actor.stopListening(util.NewError(_const.TrivialException, _const.Device, ErrAppClosed))
+	}
+	return nil
+}
+
+// 端口被重新打开后重新开始监听 丢弃旧端口的读取线程和它的错误 监听的结果仍然返回给原来的管道
+// 没有在监听时不做任何事
+// 传入：无
+// 传出：无
+func (actor *portActor) restartListening() {
+	if actor.reads == nil {
+		return
+	}
+	result := actor.listenResult
+	actor.listenResult = nil
+	actor.stopListening(nil)
+	err := actor.startListening(result)
+	if err != nil {
+		actor.app.publish(Event{Kind: EventListenStopped, COM: actor.device.COM}, _const.CommonException, err)
+		if result != nil {
+			result <- err
+		}
+	}
+}
+
+// 结束监听 没有在监听时不做任何事 监听因为错误结束时发布事件
+// 传入：监听的结果
+// 传出：无
+func (actor *portActor) stopListening(err error) {
+	if actor.reads == nil {
+		return
+	}
+	close(actor.readDone)
+	actor.app.publish(Event{Kind: EventListenStopped, COM: actor.device.COM}, _const.CommonException, err)
+	if actor.listenResult != nil {
+		actor.listenResult <- err
+	}
+	actor.reads = nil
+	actor.readErr = nil
+	actor.readDone = nil
+	actor.listenResult = nil
+	actor.receiver = nil
+}
+
+// 把讯息交给投递线程 投递队列已满时阻塞
+// 传入：模块的通道，讯息
+// 传出：错误
+func (actor *portActor) post(channel chan *SerialMessage, message *SerialMessage) error {
+	select {
+	case actor.deliveries <- delivery{channel: channel, message: message}:
+		return nil
+	case <-actor.app.ctx.Done():
+		return util.NewError(_const.TrivialException, _const.Device, ErrAppClosed)
+	}
+}
+
+// 投递线程 按顺序把讯息送到模块的通道 端口线程退出后丢弃剩余的讯息
+// 传入：无
+// 传出：无
+func (actor *portActor) deliver() {
+	for {
+		select {
+		case d := <-actor.deliveries:
+			if actor.app.deliver(d.channel, d.message) != nil {
+				return
+			}
+		case <-actor.done:
+			return
+		}
+	}
+}
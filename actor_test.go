@@ -0,0 +1,208 @@
+package device
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactHeaderFrameNumLimit(t *testing.T) {
+	app, device := initFuzzApp(t)
+	// 去掉信封的开销后正好分成maxFrameNum帧
+	queue := func(header HeaderProfile) error {
+		return device.actor.call(func() error {
+			device.codec.FrameLen = 64
+			device.codec.Header = header
+			fragmentLen := int(device.codec.payloadLen(true))
+			data := make([]byte, fragmentLen*maxFrameNum-envelopeHeaderLen-len("Bulk"))
+			_, err := app.readyToSendToDevice(nil, 0x10, "Bulk", device, &data)
+			return err
+		})
+	}
+	if err := queue(HeaderFull); err != nil {
+		t.Fatalf("完整帧头可以承载%d帧: %v", maxFrameNum, err)
+	}
+	// 紧凑帧头的总帧数字段放不下 必须在装入发送缓存时拒绝
+	if err := queue(HeaderCompact); err == nil {
+		t.Fatal("紧凑帧头放不下的数据报没有被拒绝")
+	}
+}
+
+func TestCompactHeaderPayloadLenLimit(t *testing.T) {
+	codec := &FrameCodec{FrameLen: 0x20000, Header: HeaderCompact}
+	_, err := codec.EncodeFrame(&Frame{BufferID: 1, FrameNum: 1, Payload: make([]byte, 0x10000)})
+	if !errors.Is(err, ErrFrameFieldOverflow) {
+		t.Fatalf("紧凑帧头放不下的数据长度没有被拒绝: %v", err)
+	}
+	app, device := initFuzzApp(t)
+	app.SetMTULimit(0x20000)
+	var profile *Profile
+	err = device.actor.call(func() error {
+		device.lineConfig.Header = HeaderCompact
+		device.capability = &deviceCapability{
+			versions:  []byte{ProtocolVersion},
+			checksums: []Checksum{ChecksumOddParity},
+			headers:   []HeaderProfile{HeaderCompact},
+			mtu:       0x20000,
+		}
+		var err error
+		profile, err = app.chooseProfile(device)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec = &FrameCodec{FrameLen: profile.MTU, Checksum: profile.Checksum, Header: profile.Header}
+	if profile.Header != HeaderCompact || codec.payloadLen(false) > 0xFFFF {
+		t.Fatalf("紧凑帧头协商出了过长的数据帧: %+v", profile)
+	}
+}
+
+func TestEncodeErrorFailsOnlyBuffer(t *testing.T) {
+	app, device := initFuzzApp(t)
+	events, cancel := app.SubscribeEvents(16)
+	defer cancel()
+	big := make([]byte, 300)
+	small := []byte{1, 2, 3}
+	dones := make([]chan error, 2)
+	var bigID uint32
+	err := device.actor.call(func() error {
+		for i, data := range []*[]byte{&big, &small} {
+			send, err := app.readyToSendToDevice(nil, 0x10, "Echo", device, data)
+			if err != nil {
+				return err
+			}
+			dones[i] = make(chan error, 1)
+			send.done = dones[i]
+			if i == 0 {
+				bigID = send.bufferID
+			}
+		}
+		// 重新协商出更短的数据帧 已经装入的大数据报无法编码
+		device.codec.FrameLen = 64
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.StartSendChannel("COM1"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{false, true} {
+		select {
+		case err := <-dones[i]:
+			if (err == nil) != want {
+				t.Fatalf("数据报%d的结果错误: %v", i, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("数据报%d没有结果", i)
+		}
+	}
+	for {
+		select {
+		case event := <-events:
+			if event.Kind == EventWriteFailed {
+				t.Fatalf("编码错误不应当停止发送: %+v", event)
+			}
+			if event.Kind != EventSendFailed {
+				continue
+			}
+			if event.BufferID != bigID || !strings.HasPrefix(event.Err.ErrorMessage, ErrFramePayloadTooLong.Error()) {
+				t.Fatalf("放弃的数据报不正确: %+v", event)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("无法编码的数据报没有发布事件")
+		}
+	}
+}
+
+func TestBufferIDWrap(t *testing.T) {
+	app, device := initFuzzApp(t)
+	err := device.actor.call(func() error {
+		sendBuffer := device.sendBuffer
+		data := []byte{1}
+		live := sendBuffer.RegisterSendData(nil, &data)
+		// 编号回绕后跳过仍在发送缓存中的数据块
+		sendBuffer.i = live
+		if id := sendBuffer.RegisterSendData(nil, &data); id == live {
+			t.Fatalf("回绕后覆盖了仍在使用的数据块%d", live)
+		}
+		for !sendBuffer.isFull() {
+			sendBuffer.RegisterSendData(nil, &data)
+		}
+		if _, err := app.readyToSendToDevice(nil, 0x10, "Echo", device, &data); err == nil {
+			t.Fatal("所有编号都在使用时没有拒绝新的数据报")
+		}
+		// 接收方保留收齐的数据报 同一个编号的新数据报不能被当作重复的数据帧
+		revBuffer := device.revBuffer
+		put := func(payload []byte) bool {
+			_, isCompleted, err := revBuffer.putDataFrame(&RevDataBuffer{data: &payload, bufferID: 5, frameNum: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return isCompleted
+		}
+		if !put([]byte("first")) || put([]byte("first")) {
+			t.Fatal("重复的数据帧处理错误")
+		}
+		if !put([]byte("second")) {
+			t.Fatal("复用编号的新数据报被当作重复的数据帧丢弃")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemovedBufferFinishes(t *testing.T) {
+	app, device := initFuzzApp(t)
+	overwritten := make(chan error, 1)
+	removed := make(chan error, 1)
+	err := device.actor.call(func() error {
+		sendBuffer := device.sendBuffer
+		data := []byte{1}
+		for !sendBuffer.isFull() {
+			sendBuffer.RegisterSendData(nil, &data)
+		}
+		// 发送缓存已满时覆盖的数据报必须有结果
+		sendBuffer.sendBuffer[sendBuffer.i].done = overwritten
+		sendBuffer.RegisterSendData(nil, &data)
+		sendBuffer.sendBuffer[sendBuffer.i].done = removed
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 移除下位机时发送缓存中的数据报必须有结果
+	app.RemoveDeviceFromSerialApp("COM1")
+	for name, done := range map[string]chan error{"覆盖": overwritten, "移除": removed} {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("%s的数据报不应当成功", name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s的数据报没有结果", name)
+		}
+	}
+}
+
+func TestStartSendMessageTwice(t *testing.T) {
+	app, _ := initFuzzApp(t)
+	channel := app.GetSerialMessageChannel(0x10)
+	app.StartSendMessage(0x10)
+	app.mu.Lock()
+	first := *channel.stopSendDataChannel
+	app.mu.Unlock()
+	// 再次启动时之前的发送线程必须退出 否则两个线程会争抢同一个发送管道
+	app.StartSendMessage(0x10)
+	select {
+	case <-first:
+	default:
+		t.Fatal("再次启动时没有停止之前的发送线程")
+	}
+	app.StopSendMessage(0x10)
+}
@@ -1,38 +1,142 @@
 package device
 
 import (
+	"errors"
 	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
 	"github.com/tarm/serial"
-	"time"
 )
 
 // PutDeviceIntoSerialApp 将一个下位机注册到串口应用中 实现从COM口到串口设备的映射
+// 同时为其建立发送和接收缓存 并启动独占这些状态的端口线程 同一个COM之前注册的下位机的端口线程会退出
 // 传入：下位机
 // 传出：无
 func (app *SerialApp) PutDeviceIntoSerialApp(device *SerialDevice) {
+	device.sendBuffer = initSendBuffer(app, device)
+	device.revBuffer = initRevBuffer(app, device)
+	device.actor = app.startActor(device)
+	app.mu.Lock()
+	old, ok := app.serialDevicesByCOM[device.COM]
 	app.serialDevicesByCOM[device.COM] = device
-	m := make(map[uint32]int64)
-	app.revBuffer.revBufferHangingPeriod[device.COM] = &m
+	app.mu.Unlock()
+	if ok && old != device {
+		old.actor.stop()
+	}
 }
 
-// RemoveDeviceFromSerialApp 将一个硬件从串口设备中移除
+// RemoveDeviceFromSerialApp 将一个硬件从串口设备中移除 其端口线程随之退出
 // 传入：硬件COM
 // 传出：无
 func (app *SerialApp) RemoveDeviceFromSerialApp(COM string) {
+	app.mu.Lock()
+	device, ok := app.serialDevicesByCOM[COM]
 	delete(app.serialDevicesByCOM, COM)
+	app.mu.Unlock()
+	if ok {
+		device.actor.stop()
+	}
 	app.DeregisterSubModulesWithDevice(COM)
+	app.portIDs.release(COM)
+}
+
+// 获取已经注册的下位机
+// 传入：COM
+// 传出：下位机，是否存在
+func (app *SerialApp) getDevice(COM string) (*SerialDevice, bool) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	device, ok := app.serialDevicesByCOM[COM]
+	return device, ok
+}
+
+// 获取所有已经注册的下位机的COM
+// 传入：无
+// 传出：COM
+func (app *SerialApp) getCOMs() []string {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	COMs := make([]string, 0, len(app.serialDevicesByCOM))
+	for COM := range app.serialDevicesByCOM {
+		COMs = append(COMs, COM)
+	}
+	return COMs
+}
+
+// 在某个下位机的端口线程中执行一个函数并等待其完成
+// 传入：COM，函数
+// 传出：函数返回的错误 下位机不存在或者端口线程已经退出时返回错误
+func (app *SerialApp) callDevice(COM string, f func(device *SerialDevice) error) error {
+	device, ok := app.getDevice(COM)
+	if !ok {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	}
+	return device.actor.call(func() error { return f(device) })
+}
+
+// GetDeviceSubModules 获取某个下位机在初始化时上报的功能模块
+// 传入：下位机COM
+// 传出：模块ID，是否存在
+func (app *SerialApp) GetDeviceSubModules(COM string) ([]uint32, bool) {
+	var modules []uint32
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		modules = append([]uint32{}, device.SubModuleID...)
+		return nil
+	})
+	return modules, err == nil
+}
+
+// GetDeviceID 获取某个下位机握手时分配的编号
+// 传入：下位机COM
+// 传出：握手编号，是否已经分配
+func (app *SerialApp) GetDeviceID(COM string) (byte, bool) {
+	return app.portIDs.id(COM)
+}
+
+// GetCOMByDeviceID 通过握手编号获取下位机的串口路径
+// 传入：握手编号
+// 传出：COM，是否存在
+func (app *SerialApp) GetCOMByDeviceID(id byte) (string, bool) {
+	return app.portIDs.lookup(id)
 }
 
 // OpenPort 打开某个硬件的端口
 // 传入：该硬件的COM口
 // 传出：无
 func (app *SerialApp) OpenPort(COM string) error {
-	portIO, err := serial.OpenPort(&app.serialDevicesByCOM[COM].serialConfig)
+	var device *SerialDevice
+	var config serial.Config
+	var lineConfig LineConfig
+	err := app.callDevice(COM, func(d *SerialDevice) error {
+		device, config, lineConfig = d, d.serialConfig, d.lineConfig
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	app.serialDevicesByCOM[COM].portIO = portIO
-	app.serialDevicesByCOM[COM].isConnected = true
+	return app.openPort(device, config, lineConfig)
+}
+
+// 用给定的配置打开某个下位机的端口 不经过端口线程 所以也可以在端口线程中调用
+// 传入：下位机，串口配置，线路配置
+// 传出：错误
+func (app *SerialApp) openPort(device *SerialDevice, config serial.Config, lineConfig LineConfig) error {
+	opener := device.opener
+	if opener == nil {
+		opener = OpenSerialTransport
+	}
+	portIO, err := opener(&config)
+	if err != nil {
+		return err
+	}
+	err = applyFlowControl(portIO, lineConfig.FlowControl)
+	if err != nil {
+		_ = portIO.Close()
+		return err
+	}
+	app.mu.Lock()
+	device.portIO = portIO
+	device.isConnected = true
+	app.mu.Unlock()
 
 	return nil
 }
@@ -41,19 +145,59 @@ func (app *SerialApp) OpenPort(COM string) error {
 // 传入：该硬件COM口
 // 传出：无
 func (app *SerialApp) ClosePort(COM string) error {
-	if app.serialDevicesByCOM[COM].isConnected {
-		err := app.serialDevicesByCOM[COM].portIO.Close()
+	device, ok := app.getDevice(COM)
+	if !ok {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if device.isConnected {
+		err := device.portIO.Close()
 		if err != nil {
 			return err
 		}
+		device.isConnected = false
 	}
 	return nil
 }
 
+// 某个下位机的端口是否已经打开
+// 传入：下位机
+// 传出：是否处于连接状态
+func (app *SerialApp) isConnected(device *SerialDevice) bool {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return device.isConnected
+}
+
+// SetTransportOpener 设置自动初始化时打开下位机传输的方法 传入nil时恢复为真实串口
+// 传入：打开传输的方法
+// 传出：无
+func (app *SerialApp) SetTransportOpener(opener TransportOpener) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.transportOpener = opener
+}
+
+// GetTransportInfo 获取某个下位机当前传输的元数据
+// 传入：下位机COM
+// 传出：元数据，是否处于连接状态
+func (app *SerialApp) GetTransportInfo(COM string) (TransportInfo, bool) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	device, ok := app.serialDevicesByCOM[COM]
+	if !ok || !device.isConnected {
+		return TransportInfo{}, false
+	}
+	return device.portIO.Info(), true
+}
+
 // RegisterSubModulesWithDevice 注册下位机关联模块 下位机功能模块->下位机集合 实现映射
 // 传入：关联模块moduleID，下位机COM
 // 传出：无
 func (app *SerialApp) RegisterSubModulesWithDevice(moduleID []uint32, COM string) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
 	for moduleID_ := range moduleID {
 		_, ok := app.serialDevicesBySubModuleID[moduleID[moduleID_]]
 		if !ok {
@@ -69,6 +213,8 @@ func (app *SerialApp) RegisterSubModulesWithDevice(moduleID []uint32, COM string
 // 传入：下位机COM
 // 传出：无
 func (app *SerialApp) DeregisterSubModulesWithDevice(COM string) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
 	for device := range app.serialDevicesBySubModuleID {
 		_, ok := (*app.serialDevicesBySubModuleID[device])[COM]
 		if ok {
@@ -88,6 +234,10 @@ func (app *SerialApp) GetSerialMessageChannel(nodeModuleID uint32) *SerialChanne
 	channel.SendDataChannel = &c1
 	c2 := make(chan struct{})
 	channel.stopSendDataChannel = &c2
+	c3 := make(chan *SendFailure, 16)
+	channel.SendFailedChannel = &c3
+	app.mu.Lock()
+	defer app.mu.Unlock()
 	app.serialChannelByNodeModulesID[nodeModuleID] = channel
 	return channel
 }
@@ -96,59 +246,136 @@ func (app *SerialApp) GetSerialMessageChannel(nodeModuleID uint32) *SerialChanne
 // 传入：子节点模块ID
 // 传出：无
 func (app *SerialApp) RemoveSerialChannel(nodeModuleID uint32) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
 	delete(app.serialChannelByNodeModulesID, nodeModuleID)
 }
 
+// 获取已经注册的消息通道
+// 传入：子节点模块ID
+// 传出：消息通道，是否存在
+func (app *SerialApp) getSerialChannel(nodeModuleID uint32) (*SerialChannel, bool) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	channel, ok := app.serialChannelByNodeModulesID[nodeModuleID]
+	return channel, ok
+}
+
 // StartAutoResend 开启自动重传
 // 传入：无
 // 传出：无
 func (app *SerialApp) StartAutoResend() {
-	app.GetSerialMessageChannel(_const.FeedbackModule)
-	go app.resend()
+	app.mu.Lock()
+	// 下位机发来的反馈投递到重发线程读取的通道
+	app.serialChannelByNodeModulesID[_const.FeedbackModule] = app.frameFeedbackChannel
+	if app.stopResendChannel != nil {
+		close(app.stopResendChannel)
+	}
+	stop := make(chan struct{})
+	app.stopResendChannel = stop
+	app.mu.Unlock()
+	app.goFunc(func() { app.resend(stop) })
 }
 
 // StopAutoResend 关闭自动重传
 // 传入：无
 // 传出：无
 func (app *SerialApp) StopAutoResend() {
-	app.StopSendMessage(_const.FeedbackModule)
-
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.stopResendChannel != nil {
+		close(app.stopResendChannel)
+		app.stopResendChannel = nil
+	}
 }
 
 // 重发数据
-// 传入：无
+// 传入：停止管道
 // 传出：无
-func (app *SerialApp) resend() {
+func (app *SerialApp) resend(stop chan struct{}) {
 	for {
 		select {
-		case <-*app.frameFeedbackChannel.stopSendDataChannel:
-			break
+		case <-stop:
+			return
+		case <-app.ctx.Done():
+			return
 		case msg := <-*app.frameFeedbackChannel.ReceiveDataChannel:
-			// 接收到下位机重发的数据
-			COM_ := msg.Data[8]
-			COM := "COM" + string(COM_)
-			bufferID := BytesToUint32(msg.Data[:4])
-			frameID := BytesToUint32(msg.Data[4:8])
-			if msg.TargetFunction == _const.ReSendData {
-				reData := msg.Data[9:]
-				// 载入数据并更新销毁时间戳
-				(*app.revBuffer.revBufferResidue[COM])[bufferID]--
-				(*app.revBuffer.revBufferHangingPeriod[COM])[bufferID] = time.Now().UnixMilli()
-				(*(*app.revBuffer.revBuffer[COM])[bufferID])[frameID] = &reData
-				continue
+			// 单条反馈的错误不中断重发
+			err := app.handleFeedback(msg)
+			if err != nil {
+				app.publish(app.feedbackEvent(msg), _const.TrivialException, err)
 			}
-			//收到下位机的重发通知
-			resendFrame := (*app.sendBuffer.readySendBuffer[COM])[bufferID]
-			d := *resendFrame.getFrame(frameID)
-			d = append(Uint32ToBytes(frameID), d...)
-			d = append(Uint32ToBytes(bufferID), d...)
-			*app.frameFeedbackChannel.SendDataChannel <- &SerialMessage{
-				TargetModuleID: _const.FeedbackModule,
-				TargetFunction: _const.ReSendData,
-				Data:           d,
+		}
+	}
+}
+
+// 从下位机发来的反馈中取出事件的字段 反馈过短时只有事件类型
+// 传入：反馈讯息
+// 传出：事件
+func (app *SerialApp) feedbackEvent(msg *SerialMessage) Event {
+	event := Event{Kind: EventFeedbackFailed}
+	if len(msg.Data) < 9 {
+		return event
+	}
+	event.COM, _ = app.portIDs.lookup(msg.Data[8])
+	event.HasFrame = true
+	event.BufferID = BytesToUint32(msg.Data[:4])
+	event.FrameID = BytesToUint32(msg.Data[4:8])
+	return event
+}
+
+// 处理下位机发来的反馈 格式为 数据报编号[32位] 数据报帧号[32位] 握手编号[8位] 数据
+// 下位机重发的数据帧放入接收缓存 下位机要求重发时从发送缓存中取出该数据帧重发
+// 反馈中的字段都来自下位机 超出范围时返回错误并计入统计
+// 传入：反馈讯息
+// 传出：错误
+func (app *SerialApp) handleFeedback(msg *SerialMessage) error {
+	if len(msg.Data) < 9 {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("FeedbackTooShort"))
+	}
+	COM, ok := app.portIDs.lookup(msg.Data[8])
+	if !ok {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchDeviceID"))
+	}
+	bufferID := BytesToUint32(msg.Data[:4])
+	frameID := BytesToUint32(msg.Data[4:8])
+	if msg.TargetFunction == _const.ReSendData {
+		// 接收到下位机重发的数据 总帧数以接收缓存中的为准
+		return app.callDevice(COM, func(device *SerialDevice) error {
+			frameNum, ok := device.revBuffer.pendingFrameNum(bufferID)
+			if !ok {
+				return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchRevBuffer"))
+			}
+			rev, err := InitRevDataBuffer(&Frame{BufferID: bufferID, FrameID: frameID, FrameNum: frameNum, Payload: msg.Data[9:]})
+			if err != nil {
+				device.stats.malformedFrames.Add(1)
+				return err
 			}
-		default:
-			continue
+			return device.revBuffer.submitDataFrame(rev)
+		})
+	}
+	//收到下位机的重发通知
+	var d []byte
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		resendFrame, ok := device.sendBuffer.sendBuffer[bufferID]
+		if !ok {
+			return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchSendBuffer"))
 		}
+		if frameID >= resendFrame.frameNum {
+			device.stats.malformedFrames.Add(1)
+			return &FrameError{Kind: ErrFrameHeader, Frame: &Frame{BufferID: bufferID, FrameID: frameID, FrameNum: resendFrame.frameNum}}
+		}
+		d = *resendFrame.getFrame(frameID)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	d = append(Uint32ToBytes(frameID), d...)
+	d = append(Uint32ToBytes(bufferID), d...)
+	return app.deliver(*app.frameFeedbackChannel.SendDataChannel, &SerialMessage{
+		TargetModuleID: _const.FeedbackModule,
+		TargetFunction: _const.ReSendData,
+		Data:           d,
+	})
 }
@@ -0,0 +1,267 @@
+package device
+
+import (
+	"errors"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 协商出逐帧确认的下位机使用选择重传 接收方每收到一个普通数据帧（包括重复的）都回复确认
+ 确认是发往FeedbackModule的FrameAck讯息 数据是 接收窗口[16位] 然后是若干个 数据报编号[32位] 数据帧号[32位]
+ 作为控制讯息发送 本身不需要确认 接收窗口见window.go
+ 发送方为每个发出的数据帧设置确认超时 超时后只重发该帧 同一帧的发送次数达到maxResendTimes仍未确认时放弃整个数据报
+ 并通过发送该讯息的SerialChannel的SendFailedChannel报告失败 所有数据帧都被确认后立即删除该数据报
+ 数据报编号0-0xFFF是普通数据报 0x1000-0xFFFF是控制讯息 控制讯息不确认也不重发
+*/
+
+// FrameAck 数据帧确认的功能名
+const FrameAck = "FrameAck"
+
+// 控制讯息使用的数据块号的起点
+const controlBufferIDStart uint32 = 0x1000
+
+// 默认的确认超时时间
+const defaultAckTimeout = 200 * time.Millisecond
+
+// 确认中接收窗口的长度
+const frameAckWindowLen = 2
+
+// 确认中每一项的长度
+const frameAckLen = 8
+
+// ErrResendTimesExceeded 数据帧的发送次数达到上限仍未被确认
+var ErrResendTimesExceeded = errors.New("ResendTimesExceeded")
+
+// ErrSendBufferFull 所有普通数据块号都在使用 发送缓存中的数据报还没有结果
+var ErrSendBufferFull = errors.New("SendBufferFull")
+
+// ErrSendBufferTimeOut 数据报在发送缓存中保留的时间超过了SendBufferWaitTimeOut
+var ErrSendBufferTimeOut = errors.New("SendBufferTimeOut")
+
+// SendFailure 发送失败的讯息
+type SendFailure struct {
+	// 下位机COM
+	COM string
+	// 发送失败的讯息
+	Message *SerialMessage
+	// 数据报编号
+	BufferID uint32
+	// 没有被确认的数据帧号
+	FrameID uint32
+	// 失败的原因
+	Err error
+}
+
+// 是否是控制讯息的数据块号
+// 传入：数据块号
+// 传出：是否是控制讯息
+func isControlBufferID(bufferID uint32) bool {
+	return bufferID >= controlBufferIDStart
+}
+
+// 编码数据帧确认 没有数据帧时只通告接收窗口
+// 传入：接收窗口，确认的数据帧
+// 传出：确认的数据
+func encodeFrameAck(window uint32, frames ...*Frame) []byte {
+	data := make([]byte, 0, frameAckWindowLen+len(frames)*frameAckLen)
+	data = append(data, uint16ToBytes(window)...)
+	for _, frame := range frames {
+		data = append(data, Uint32ToBytes(frame.BufferID)...)
+		data = append(data, Uint32ToBytes(frame.FrameID)...)
+	}
+	return data
+}
+
+// SetAckTimeout 设置等待数据帧确认的基础时间 实际的超时还会加上在途数据帧的传输时间 默认为200毫秒
+// 传入：超时时间
+// 传出：无
+func (app *SerialApp) SetAckTimeout(timeout time.Duration) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.ackTimeout = timeout
+}
+
+// 为发送数据块开启逐帧确认
+// 传入：无
+// 传出：无
+func (sendDataBuffer *SendDataBuffer) enableARQ() {
+	sendDataBuffer.isARQ = true
+	sendDataBuffer.acked = make([]bool, sendDataBuffer.frameNum)
+	sendDataBuffer.unacked = sendDataBuffer.frameNum
+	sendDataBuffer.deadlines = make([]int64, sendDataBuffer.frameNum)
+	sendDataBuffer.sendTimes = make([]int, sendDataBuffer.frameNum)
+}
+
+// 选出逐帧确认的数据块下一个需要发送的数据帧 先发送还没有发过的 再重发确认超时的
+// 传入：当前时间 毫秒，每帧最多发送的次数，是否可以发送还没有发过的数据帧
+// 传出：数据帧号，是否有需要发送的数据帧，发送次数达到上限的数据帧号（没有时为-1）
+func (sendDataBuffer *SendDataBuffer) nextARQFrame(nowTime int64, maxSendTimes int, canSendNew bool) (uint32, bool, int64) {
+	if canSendNew && sendDataBuffer.frameID < sendDataBuffer.frameNum {
+		frameID := sendDataBuffer.frameID
+		sendDataBuffer.frameID++
+		return frameID, true, -1
+	}
+	for frameID, deadline := range sendDataBuffer.deadlines {
+		if sendDataBuffer.acked[frameID] || deadline == 0 || deadline > nowTime {
+			continue
+		}
+		if sendDataBuffer.sendTimes[frameID] >= maxSendTimes {
+			return 0, false, int64(frameID)
+		}
+		return uint32(frameID), true, -1
+	}
+	return 0, false, -1
+}
+
+// 在途的数据帧数 也就是已经发送还没有确认的数据帧 确认超时的也算在内 它们可能仍然占用着接收方的缓冲区
+// 传入：无
+// 传出：数据帧数
+func (sendDataBuffer *SendDataBuffer) inFlight() int {
+	n := 0
+	for frameID, deadline := range sendDataBuffer.deadlines {
+		if !sendDataBuffer.acked[frameID] && deadline != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// 最早的确认超时时间
+// 传入：无
+// 传出：时间 毫秒 没有等待确认的数据帧时为0
+func (sendDataBuffer *SendDataBuffer) nextDeadline() int64 {
+	next := int64(0)
+	for frameID, deadline := range sendDataBuffer.deadlines {
+		if !sendDataBuffer.acked[frameID] && deadline != 0 && (next == 0 || deadline < next) {
+			next = deadline
+		}
+	}
+	return next
+}
+
+// 端口线程下一次需要检查的时间 也就是最早的确认超时时间 或者接收窗口为0时发送探测的时间
+// 只有数据报在等待窗口并且没有在途的数据帧时才会发送探测 见canSendNewFrame 否则探测时间过去后端口线程会一直被唤醒
+// 传入：确认超时 毫秒
+// 传出：时间 毫秒 为0时不需要
+func (sendBuffer *SendBuffer) nextWakeTime(ackTimeout int64) int64 {
+	next := int64(0)
+	isWaiting := false
+	inFlight := 0
+	for _, send := range sendBuffer.readySendBuffer {
+		if !send.isARQ {
+			continue
+		}
+		if deadline := send.nextDeadline(); deadline != 0 && (next == 0 || deadline < next) {
+			next = deadline
+		}
+		inFlight += send.inFlight()
+		if send.frameID < send.frameNum {
+			isWaiting = true
+		}
+	}
+	device := sendBuffer.device
+	if probe := device.windowUpdatedAt + ackTimeout + 1; device.sendWindow == 0 && isWaiting && inFlight == 0 && (next == 0 || probe < next) {
+		next = probe
+	}
+	return next
+}
+
+// 单个数据帧在线路上的传输时间 毫秒
+// 传入：无
+// 传出：传输时间
+func (device *SerialDevice) frameAirtime() int64 {
+	baud := device.serialConfig.Baud
+	if baud <= 0 {
+		return 0
+	}
+	// 每个字节有起始位和停止位 按10位计算
+	return int64(device.codec.FrameLen) * 10 * 1000 / int64(baud)
+}
+
+// 处理下位机发来的数据帧确认 所有数据帧都被确认的数据报立即删除 同时更新发送窗口
+// 传入：确认的数据
+// 传出：错误
+func (sendBuffer *SendBuffer) acknowledge(data []byte) error {
+	if len(data) < frameAckWindowLen || (len(data)-frameAckWindowLen)%frameAckLen != 0 {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("BadFrameAck"))
+	}
+	sendBuffer.device.updateSendWindow(bytesToUint16(data), time.Now().UnixMilli())
+	for i := frameAckWindowLen; i < len(data); i += frameAckLen {
+		bufferID := BytesToUint32(data[i : i+4])
+		frameID := BytesToUint32(data[i+4 : i+8])
+		// 已经删除的数据报的确认可能迟到 直接忽略
+		send, ok := sendBuffer.sendBuffer[bufferID]
+		if !ok || !send.isARQ || frameID >= send.frameNum || send.acked[frameID] {
+			continue
+		}
+		send.acked[frameID] = true
+		send.unacked--
+		if send.unacked == 0 {
+			sendBuffer.removeSendData(bufferID, nil)
+		}
+	}
+	return nil
+}
+
+// 从发送缓冲区中删除一个数据报 还没有结果的同步发送以传入的错误结束
+// 传入：数据报编号，错误 为nil时成功
+// 传出：无
+func (sendBuffer *SendBuffer) removeSendData(bufferID uint32, err error) {
+	send, ok := sendBuffer.sendBuffer[bufferID]
+	delete(sendBuffer.sendBuffer, bufferID)
+	delete(sendBuffer.readySendBuffer, bufferID)
+	delete(sendBuffer.sendBufferWaitTime, bufferID)
+	if ok {
+		send.finish(err)
+	}
+}
+
+// 删除发送缓冲区中的所有数据报 例如端口线程退出时 还没有结果的同步发送以传入的错误结束
+// 传入：错误
+// 传出：无
+func (sendBuffer *SendBuffer) removeAllSendData(err error) {
+	for bufferID := range sendBuffer.sendBuffer {
+		sendBuffer.removeSendData(bufferID, err)
+	}
+}
+
+// 放弃一个数据报 例如发送次数达到上限或者无法编码为数据帧 发布事件并报告给发送该讯息的消息通道
+// 报告通道已满时丢弃报告 以免阻塞端口线程
+// 传入：数据块，出错的数据帧号，事件类型，错误
+// 传出：无
+func (sendBuffer *SendBuffer) failSendData(send *SendDataBuffer, frameID uint32, kind EventKind, err error) {
+	sendBuffer.removeSendData(send.bufferID, err)
+	sendBuffer.device.stats.failedMessages.Add(1)
+	event := Event{Kind: kind, COM: sendBuffer.device.COM, HasFrame: true, BufferID: send.bufferID, FrameID: frameID}
+	if send.message != nil {
+		event.ModuleID = send.message.TargetModuleID
+	}
+	sendBuffer.app.publish(event, _const.CommonException, err)
+	if send.channel == nil || send.channel.SendFailedChannel == nil {
+		return
+	}
+	select {
+	case *send.channel.SendFailedChannel <- &SendFailure{
+		COM:      sendBuffer.device.COM,
+		Message:  send.message,
+		BufferID: send.bufferID,
+		FrameID:  frameID,
+		Err:      err,
+	}:
+	default:
+	}
+}
+
+// 确认下位机发来的普通数据帧
+// 传入：下位机，数据帧
+// 传出：错误
+func (app *SerialApp) sendFrameAck(device *SerialDevice, frame *Frame) error {
+	return app.sendControlMessage(device, &SerialMessage{
+		TargetModuleID: _const.FeedbackModule,
+		TargetFunction: FrameAck,
+		Data:           encodeFrameAck(unlimitedWindow, frame),
+	})
+}
@@ -0,0 +1,203 @@
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 配置了预共享密钥的下位机 收发的每个消息信封都需要认证
+ 认证后的消息信封是 消息信封 序列号[64位] HMAC-SHA256[截断为16字节] 消息信封标志位中置位envelopeFlagAuthenticated
+ HMAC覆盖方向 握手随机数 消息信封和序列号 方向使得一方发出的讯息不能被原样反射回去
+ 序列号在每个方向上单调递增 多个数据报交错发送时重组完成的顺序可能和序列号不同
+ 所以接收方和IPsec一样维护一个长度为64的窗口 拒绝窗口之前的和窗口中已经收到的序列号 以防止重放
+ 下位机重新握手后两个方向的序列号都重新开始 所以上位机每次握手都生成新的随机数 紧跟在握手编号之后发给下位机
+ 之前的会话中录下的讯息因为随机数不同而无法通过认证
+*/
+
+// 消息信封标志位 消息信封带有序列号和HMAC
+const envelopeFlagAuthenticated byte = 0x10
+
+// 序列号长度
+const authSeqLen = 8
+
+// 重放窗口的长度
+const replayWindowLen = 64
+
+// 截断后的HMAC长度
+const authTagLen = 16
+
+// 握手随机数的长度
+const authNonceLen = 16
+
+// 认证的方向
+const (
+	// 上位机发往下位机
+	authToDevice byte = 1
+	// 下位机发往上位机
+	authToHost byte = 2
+)
+
+// 认证失败的类型
+var (
+	// ErrAuthMissing 配置了密钥的下位机发来了没有认证的讯息
+	ErrAuthMissing = errors.New("AuthenticationMissing")
+	// ErrAuthFailed HMAC不正确
+	ErrAuthFailed = errors.New("AuthenticationFailed")
+	// ErrReplay 序列号已经收到过或者过旧 也就是重放的讯息
+	ErrReplay = errors.New("ReplayedMessage")
+)
+
+// 重放窗口 记录最大的序列号和它之前replayWindowLen个序列号是否收到过
+type replayWindow struct {
+	// 收到的最大序列号
+	max uint64
+	// 第i位表示序列号max-i是否收到过
+	seen uint64
+}
+
+// 检查序列号是否可以接受 可以接受时记录下来
+// 传入：序列号
+// 传出：是否可以接受
+func (window *replayWindow) accept(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > window.max {
+		shift := seq - window.max
+		if shift >= replayWindowLen {
+			window.seen = 0
+		} else {
+			window.seen <<= shift
+		}
+		window.seen |= 1
+		window.max = seq
+		return true
+	}
+	offset := window.max - seq
+	if offset >= replayWindowLen || window.seen&(1<<offset) != 0 {
+		return false
+	}
+	window.seen |= 1 << offset
+	return true
+}
+
+// 计算消息信封的HMAC
+// 传入：密钥，握手随机数，方向，消息信封和序列号
+// 传出：截断后的HMAC
+func authTag(key []byte, nonce []byte, direction byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{direction})
+	mac.Write(nonce)
+	mac.Write(data)
+	return mac.Sum(nil)[:authTagLen]
+}
+
+// 为消息信封加上序列号和HMAC
+// 传入：密钥，握手随机数，方向，序列号，消息信封
+// 传出：认证后的消息信封
+func sealEnvelope(key []byte, nonce []byte, direction byte, seq uint64, data []byte) []byte {
+	sealed := make([]byte, 0, len(data)+authSeqLen+authTagLen)
+	sealed = append(sealed, data...)
+	sealed[4] |= envelopeFlagAuthenticated
+	sealed = append(sealed, Uint32ToBytes(uint32(seq>>32))...)
+	sealed = append(sealed, Uint32ToBytes(uint32(seq))...)
+	return append(sealed, authTag(key, nonce, direction, sealed)...)
+}
+
+// 验证消息信封的序列号和HMAC
+// 传入：密钥，握手随机数，方向，重放窗口，认证后的消息信封
+// 传出：去掉认证的消息信封，错误
+func openEnvelope(key []byte, nonce []byte, direction byte, window *replayWindow, data []byte) ([]byte, error) {
+	if len(data) < envelopeHeaderLen+authSeqLen+authTagLen || data[4]&envelopeFlagAuthenticated == 0 {
+		return nil, ErrAuthMissing
+	}
+	tagStart := len(data) - authTagLen
+	if !hmac.Equal(authTag(key, nonce, direction, data[:tagStart]), data[tagStart:]) {
+		return nil, ErrAuthFailed
+	}
+	seqStart := tagStart - authSeqLen
+	seq := uint64(BytesToUint32(data[seqStart:]))<<32 | uint64(BytesToUint32(data[seqStart+4:]))
+	// HMAC正确之后才记录序列号 以免伪造的讯息占用窗口
+	if !window.accept(seq) {
+		return nil, ErrReplay
+	}
+	opened := make([]byte, seqStart)
+	copy(opened, data[:seqStart])
+	opened[4] &^= envelopeFlagAuthenticated
+	return opened, nil
+}
+
+// SetPreSharedKey 为某个串口路径上的下位机设置预共享密钥 需要在该下位机初始化之前调用
+// 设置后收发的每个讯息都需要认证 包括初始化握手的讯息 认证失败的讯息被丢弃并计入统计
+// 传入：COM，密钥（为nil时不认证）
+// 传出：无
+func (app *SerialApp) SetPreSharedKey(COM string, key []byte) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if key == nil {
+		delete(app.preSharedKeys, COM)
+		return
+	}
+	app.preSharedKeys[COM] = append([]byte{}, key...)
+}
+
+// 开始新的认证会话 生成新的握手随机数 两个方向的序列号重新开始 在该下位机的端口线程中调用
+// 传入：握手编号
+// 传出：握手的数据 也就是握手编号 配置了密钥时之后是握手随机数，错误
+func (device *SerialDevice) startSession(deviceID byte) ([]byte, error) {
+	device.deviceID = deviceID
+	if device.authKey == nil {
+		return []byte{deviceID}, nil
+	}
+	nonce := make([]byte, authNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, util.NewError(_const.CommonException, _const.Device, err)
+	}
+	device.authNonce = nonce
+	device.sendSeq.Store(0)
+	device.revWindow = replayWindow{}
+	return append([]byte{deviceID}, nonce...), nil
+}
+
+// 获取握手的数据 重新发送握手时使用 在该下位机的端口线程中调用
+// 传入：无
+// 传出：握手的数据
+func (device *SerialDevice) handshakeData() []byte {
+	return append([]byte{device.deviceID}, device.authNonce...)
+}
+
+// 为发往某个下位机的消息信封加上认证 没有配置密钥时原样返回
+// 传入：消息信封
+// 传出：消息信封
+func (device *SerialDevice) sealEnvelope(data []byte) []byte {
+	if device.authKey == nil {
+		return data
+	}
+	return sealEnvelope(device.authKey, device.authNonce, authToDevice, device.sendSeq.Add(1), data)
+}
+
+// 验证某个下位机发来的消息信封 没有配置密钥时原样返回 认证失败的讯息计入统计
+// 只能由该下位机的接收线程调用
+// 传入：消息信封
+// 传出：去掉认证的消息信封，错误
+func (device *SerialDevice) openEnvelope(data []byte) ([]byte, error) {
+	if device.authKey == nil {
+		return data, nil
+	}
+	opened, err := openEnvelope(device.authKey, device.authNonce, authToHost, &device.revWindow, data)
+	if errors.Is(err, ErrReplay) {
+		device.stats.replays.Add(1)
+	} else if err != nil {
+		device.stats.authFailures.Add(1)
+	}
+	if err != nil {
+		return nil, util.NewError(_const.TrivialException, _const.Device, err)
+	}
+	return opened, nil
+}
@@ -0,0 +1,182 @@
+package device
+
+import (
+	"errors"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+// SetBaudDetection 开启自动识别波特率 自动初始化时会依次用候选波特率发送握手 保留第一个收到有效初始化应答的波特率
+// 传入nil时关闭自动识别 只使用线路配置中的波特率
+// 传入：候选波特率，每个波特率等待应答的时间
+// 传出：无
+func (app *SerialApp) SetBaudDetection(candidates []int, timeout time.Duration) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.baudCandidates = candidates
+	app.baudDetectTimeout = timeout
+}
+
+// DetectBaud 识别一个已经注册的下位机的波特率 识别到的波特率会保存到该下位机的线路配置中 识别失败时恢复原来的线路配置
+// 识别时会直接读取端口 所以需要在开始监听该下位机之前调用
+// 读取等待时间为0或者超过每个波特率等待应答的时间时 识别期间使用后者 以免在没有应答的端口上一直阻塞
+// 传入：下位机COM
+// 传出：识别到的波特率，错误
+func (app *SerialApp) DetectBaud(COM string) (int, error) {
+	device, ok := app.getDevice(COM)
+	if !ok {
+		return 0, util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	}
+	app.mu.Lock()
+	candidates, timeout := app.baudCandidates, app.baudDetectTimeout
+	app.mu.Unlock()
+	original, _ := app.GetLineConfig(COM)
+	probeConfig := original
+	if probeConfig.ReadTimeout <= 0 || probeConfig.ReadTimeout > timeout {
+		probeConfig.ReadTimeout = timeout
+	}
+	var lastErr error
+	for _, baud := range candidates {
+		config := probeConfig
+		config.Baud = baud
+		err := app.SetLineConfig(COM, config)
+		if err == nil && !app.isConnected(device) {
+			err = app.OpenPort(COM)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ok, err := app.probeInit(COM, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ok {
+			// 恢复原来的读取等待时间
+			if config.ReadTimeout != original.ReadTimeout {
+				config.ReadTimeout = original.ReadTimeout
+				err = app.SetLineConfig(COM, config)
+			}
+			return baud, err
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("BaudNotDetected")
+	}
+	// 不要停在最后一个候选波特率上
+	_ = app.SetLineConfig(COM, original)
+	return 0, util.NewError(_const.CommonException, _const.Device, lastErr)
+}
+
+// 发送握手并等待该下位机的初始化应答 收到后注册其功能模块
+// 端口由当前线程直接读取 读到的数据交给端口线程切分和重组
+// 传入：下位机COM，等待时间
+// 传出：是否收到有效应答，错误
+func (app *SerialApp) probeInit(COM string, timeout time.Duration) (bool, error) {
+	device, ok := app.getDevice(COM)
+	if !ok {
+		return false, util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	}
+	deviceID, _ := app.portIDs.id(COM)
+	portIO := app.getPortIO(device)
+	// 丢弃上一个波特率留下的数据
+	err := portIO.Flush()
+	if err != nil {
+		return false, err
+	}
+	var handshake []byte
+	var receiver *frameReceiver
+	err = device.actor.call(func() error {
+		handshake = device.handshakeData()
+		receiver = initFrameReceiver(device.codec, device.stats)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = portIO.Write(handshake)
+	if err != nil {
+		return false, err
+	}
+	listenBuffer := make([]byte, _const.PortLen)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		read, err := portIO.Read(listenBuffer)
+		if err != nil {
+			return false, err
+		}
+		var messages []*SerialMessage
+		err = device.actor.call(func() error {
+			receiver.push(listenBuffer[:read])
+			messages = device.revBuffer.receiveMessages(receiver)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, message := range messages {
+			// 能力声明在初始化应答之前到达
+			if isInitMessage(message, InitCapability, deviceID) {
+				_ = app.handleInitCapability(message.Data)
+				continue
+			}
+			if !isInitMessage(message, _const.InitData, deviceID) {
+				continue
+			}
+			_, err = app.handleInitData(message.Data)
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+// 从接收器中取出所有数据帧并重组 返回收齐的讯息 出错的数据帧和讯息直接丢弃 在端口线程中调用
+// 传入：接收器
+// 传出：讯息
+func (revBuffer *RevBuffer) receiveMessages(receiver *frameReceiver) []*SerialMessage {
+	device := revBuffer.device
+	messages := make([]*SerialMessage, 0)
+	for {
+		frame, ok, err := receiver.next()
+		if !ok {
+			return messages
+		}
+		if err != nil {
+			continue
+		}
+		rev, err := InitRevDataBuffer(frame)
+		if err != nil {
+			device.stats.malformedFrames.Add(1)
+			continue
+		}
+		data, isCompleted, err := revBuffer.putDataFrame(rev)
+		if err != nil {
+			device.stats.malformedFrames.Add(1)
+			continue
+		}
+		if !isCompleted {
+			continue
+		}
+		opened, err := device.openEnvelope(*data)
+		if err != nil {
+			continue
+		}
+		message, err := ParseDataToSerialMessage(&opened)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+}
+
+// 判断一条讯息是否是某个下位机的某种初始化讯息
+// 传入：讯息，功能名，握手编号
+// 传出：是否是该下位机的该种初始化讯息
+func isInitMessage(message *SerialMessage, function string, deviceID byte) bool {
+	return message.TargetModuleID == _const.InitModule &&
+		message.TargetFunction == function &&
+		len(message.Data) > 0 && message.Data[0] == deviceID
+}
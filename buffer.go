@@ -1,109 +1,252 @@
 package device
 
 import (
+	"bytes"
 	"errors"
-	_const "github.com/238Studio/child-nodes-assist/const"
+	"fmt"
+	"math"
 	"time"
 
-	"math"
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
 )
 
+// 初始化一个下位机的发送缓冲器
+// 传入：App，下位机
+// 传出：发送缓冲器
+func initSendBuffer(app *SerialApp, device *SerialDevice) *SendBuffer {
+	return &SendBuffer{
+		sendBuffer:         make(map[uint32]*SendDataBuffer),
+		readySendBuffer:    make(map[uint32]*SendDataBuffer),
+		sendBufferWaitTime: make(map[uint32]int64),
+		i:                  0,
+		j:                  0xFFF,
+		device:             device,
+		app:                app,
+	}
+}
+
+// 初始化一个下位机的接收缓冲器
+// 传入：App，下位机
+// 传出：接收缓冲器
+func initRevBuffer(app *SerialApp, device *SerialDevice) *RevBuffer {
+	return &RevBuffer{
+		revBuffer:              make(map[uint32]*[]*[]byte),
+		revBufferHangingPeriod: make(map[uint32]int64),
+		revBufferResidue:       make(map[uint32]uint32),
+		device:                 device,
+		app:                    app,
+	}
+}
+
+// 初始化发送数据块 按每帧承载的数据长度计算总帧数
+// 传入：数据，数据块号，每帧承载的数据长度
+// 传出：发送数据块
+func initSendDataBuffer(data *[]byte, bufferID uint32, payloadLen uint32) *SendDataBuffer {
+	buffer := &SendDataBuffer{
+		data:       data,
+		frameID:    0,
+		bufferID:   bufferID,
+		frameNum:   uint32(math.Ceil(float64(len(*data)) / float64(payloadLen))),
+		payloadLen: payloadLen,
+	}
+	// 空数据也需要一帧来传递
+	if buffer.frameNum == 0 {
+		buffer.frameNum = 1
+	}
+	return buffer
+}
+
 // 获取下一个数据块以及其id，如果不存在下一个数据块则返回error
 // 传入：无
 // 传出：无
 func (sendDataBuffer *SendDataBuffer) nextDataFrame() (err error, frameID uint32, dataFrame *[]byte) {
 	// 如果到了最后一个数据帧 则返回错误
 	if sendDataBuffer.frameID >= sendDataBuffer.frameNum {
-		return errors.New(""), 0, nil
+		return errors.New("NoMoreFrame"), 0, nil
 	}
-	defer func() { sendDataBuffer.bufferID++ }()
-	re := (*sendDataBuffer.data)[sendDataBuffer.frameID*(_const.PortLen-17) : (sendDataBuffer.frameID+1)*(_const.PortLen-17)]
-	return nil, sendDataBuffer.frameID, &re
+	defer func() { sendDataBuffer.frameID++ }()
+	return nil, sendDataBuffer.frameID, sendDataBuffer.getFrame(sendDataBuffer.frameID)
 }
 
 // 获取某个数据帧的数据
 // 传入：数据帧号
 // 传出：数据
 func (sendDataBuffer *SendDataBuffer) getFrame(frameID uint32) *[]byte {
-	re := (*sendDataBuffer.data)[frameID*(_const.PortLen-17) : (sendDataBuffer.frameID+1)*(_const.PortLen-17)]
+	start := frameID * sendDataBuffer.payloadLen
+	end := start + sendDataBuffer.payloadLen
+	if end > uint32(len(*sendDataBuffer.data)) {
+		end = uint32(len(*sendDataBuffer.data))
+	}
+	re := (*sendDataBuffer.data)[start:end]
 	return &re
 }
 
-// ReadySend 开始发送指定缓存数据块的数据
-// 传入：COM号，该数据块的消息通道，数据块号
+// ReadySend 开始发送指定缓存数据块的数据 端口线程会在下一轮发送它
+// 传入：数据块号
 // 传出：无
-func (sendBuffer *SendBuffer) ReadySend(COM string, channel *SerialChannel, bufferID uint32) {
-	_, ok := sendBuffer.readySendBuffer[COM]
-	if !ok {
-		m0 := make(map[uint32]*SendDataBuffer)
-		sendBuffer.readySendBuffer[COM] = &m0
-	}
-	(*sendBuffer.readySendBuffer[COM])[bufferID] = (*sendBuffer.sendBuffer[COM])[bufferID]
+func (sendBuffer *SendBuffer) ReadySend(bufferID uint32) {
+	sendBuffer.readySendBuffer[bufferID] = sendBuffer.sendBuffer[bufferID]
 }
 
-// RegisterSendData 生成并注册缓冲数据块
-// 传入：需要发送的数据
+// RegisterSendData 生成并注册缓冲数据块 编号回绕时跳过仍在发送缓存中的数据块
+// 发送缓存已满时会覆盖仍在使用的编号 被覆盖的数据报以ErrSendBufferFull结束 调用前需要用isFull确认还有空闲的编号
+// 传入：该数据块的消息通道，需要发送的数据
 // 传出：数据块号
-func (sendBuffer *SendBuffer) RegisterSendData(COM string, channel *SerialChannel, data *[]byte) uint32 {
-	buffer := SendDataBuffer{
-		data:     data,
-		frameID:  0,
-		bufferID: sendBuffer.i,
-		frameNum: uint32(math.Ceil(float64(uint32(len(*data)) / _const.PortLen))),
-	}
-	(*sendBuffer.sendBuffer[COM])[sendBuffer.i] = &buffer
-	if sendBuffer.i > 0xFFE {
-		sendBuffer.i = 0
-	}
-	sendBuffer.i++
+func (sendBuffer *SendBuffer) RegisterSendData(channel *SerialChannel, data *[]byte) uint32 {
+	for n := uint32(0); n < controlBufferIDStart && sendBuffer.sendBuffer[sendBuffer.i] != nil; n++ {
+		sendBuffer.nextBufferID()
+	}
+	id := sendBuffer.nextBufferID()
+	sendBuffer.removeSendData(id, util.NewError(_const.TrivialException, _const.Device, ErrSendBufferFull))
+	buffer := initSendDataBuffer(data, id, sendBuffer.device.codec.fragmentLen(len(*data)))
+	buffer.channel = channel
+	sendBuffer.sendBuffer[id] = buffer
 	return buffer.bufferID
 }
 
+// 分配下一个普通数据块号 不检查是否仍在使用
+// 传入：无
+// 传出：数据块号
+func (sendBuffer *SendBuffer) nextBufferID() uint32 {
+	id := sendBuffer.i
+	sendBuffer.i = (sendBuffer.i + 1) % controlBufferIDStart
+	return id
+}
+
+// 发送缓存中的数据块是否已经用完了所有普通数据块号
+// 传入：无
+// 传出：是否已满
+func (sendBuffer *SendBuffer) isFull() bool {
+	return uint32(len(sendBuffer.sendBuffer)) >= controlBufferIDStart
+}
+
+// 分配控制讯息使用的数据块号 和普通数据块的编号不重叠 并且不超过紧凑帧头的16位
+// 传入：无
+// 传出：数据块号
+func (sendBuffer *SendBuffer) nextControlBufferID() uint32 {
+	if sendBuffer.j == 0xFFFF {
+		sendBuffer.j = controlBufferIDStart - 1
+	}
+	sendBuffer.j++
+	return sendBuffer.j
+}
+
 // 呈递数据片段 将刚刚接收到的数据片段呈递给缓冲区 缓冲区会放入数据片段并判断是否可以返回数据片段
+// 收齐的讯息交给投递线程送到模块
 // 传入：数据帧
 // 传出：无
-func (revBuffer *RevBuffer) submitDataFrame(COM string, buffer *RevDataBuffer) error {
-	// 进行奇校验
-	if !VerifyOddParity(buffer.data) {
-		// 要求重发 bufferID frameID
-		*revBuffer.app.frameFeedbackChannel.SendDataChannel <- &SerialMessage{
-			TargetModuleID: _const.FeedbackModule,
-			TargetFunction: _const.WrongOddVariation,
-			Data:           append(Uint32ToBytes(buffer.bufferID), Uint32ToBytes(buffer.frameID)...),
+func (revBuffer *RevBuffer) submitDataFrame(buffer *RevDataBuffer) error {
+	revData, isCompleted, err := revBuffer.putDataFrame(buffer)
+	if err != nil || !isCompleted {
+		return err
+	}
+	device := revBuffer.device
+	// 配置了密钥时 认证失败的讯息直接丢弃
+	opened, err := device.openEnvelope(*revData)
+	if err != nil {
+		return err
+	}
+	// 将数据发送到指定通道
+	message, err := ParseDataToSerialMessage(&opened)
+	if err != nil {
+		device.stats.droppedMessages.Add(1)
+		return err
+	}
+	// 数据帧确认由发送缓冲区处理 不交给模块
+	if message.TargetModuleID == _const.FeedbackModule && message.TargetFunction == FrameAck {
+		return device.sendBuffer.acknowledge(message.Data)
+	}
+	channel, ok := revBuffer.app.getSerialChannel(message.TargetModuleID)
+	if !ok {
+		device.stats.droppedMessages.Add(1)
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchModuleChannel"))
+	}
+	// 将数据发送给需要的模块
+	return device.actor.post(*channel.ReceiveDataChannel, message)
+}
+
+// 要求下位机重发校验失败的数据帧
+// 传入：帧头能够解析的数据帧
+// 传出：无
+func (revBuffer *RevBuffer) requestResend(frame *Frame) {
+	// 要求重发 bufferID frameID
+	_ = revBuffer.device.actor.post(*revBuffer.app.frameFeedbackChannel.SendDataChannel, &SerialMessage{
+		TargetModuleID: _const.FeedbackModule,
+		TargetFunction: _const.WrongOddVariation,
+		Data:           append(Uint32ToBytes(frame.BufferID), Uint32ToBytes(frame.FrameID)...),
+	})
+}
+
+// 获取正在接收的数据报的总帧数
+// 传入：数据报编号
+// 传出：总帧数，是否正在接收
+func (revBuffer *RevBuffer) pendingFrameNum(bufferID uint32) (uint32, bool) {
+	data, ok := revBuffer.revBuffer[bufferID]
+	if !ok {
+		return 0, false
+	}
+	return uint32(len(*data)), true
+}
+
+// 清理超时的接收缓存
+// 传入：无
+// 传出：无
+func (revBuffer *RevBuffer) clean() {
+	nowTime := time.Now().UnixMilli()
+	for bufferID, lastTime := range revBuffer.revBufferHangingPeriod {
+		if (nowTime - lastTime) > revBuffer.app.RevBufferWaitTimeOut {
+			delete(revBuffer.revBufferResidue, bufferID)
+			delete(revBuffer.revBuffer, bufferID)
+			delete(revBuffer.revBufferHangingPeriod, bufferID)
 		}
 	}
-	data, ok := (*(revBuffer.revBuffer[COM]))[buffer.bufferID]
+}
+
+// 放入数据片段 如果该数据报的所有数据帧都已经收到 则返回拼接后的数据
+// 传入：数据帧
+// 传出：拼接后的数据，是否已经收齐，错误
+func (revBuffer *RevBuffer) putDataFrame(buffer *RevDataBuffer) (*[]byte, bool, error) {
+	if buffer.frameNum == 0 || buffer.frameID >= buffer.frameNum {
+		return nil, false, &FrameError{Kind: ErrFrameHeader, Detail: fmt.Sprintf("frameID %d>=%d", buffer.frameID, buffer.frameNum)}
+	}
+	data, ok := revBuffer.revBuffer[buffer.bufferID]
+	// 收齐的数据报保留到超时 期间发送方的编号可能回绕 总帧数或者内容不同的数据帧属于新的数据报
+	if ok && revBuffer.revBufferResidue[buffer.bufferID] == 0 &&
+		(uint32(len(*data)) != buffer.frameNum || !bytes.Equal(*(*data)[buffer.frameID], *buffer.data)) {
+		delete(revBuffer.revBuffer, buffer.bufferID)
+		ok = false
+	}
+	// 同一个数据报的总帧数必须一致 否则帧号可能超出已经分配的空间
+	if ok && uint32(len(*data)) != buffer.frameNum {
+		return nil, false, &FrameError{Kind: ErrFrameHeader, Detail: fmt.Sprintf("frameNum %d!=%d", buffer.frameNum, len(*data))}
+	}
 	// 如果是新的buffer
 	if !ok {
 		d := make([]*[]byte, buffer.frameNum)
+		data = &d
 		// 分配空间
-		(*(revBuffer.revBuffer[COM]))[buffer.bufferID] = &d
-		// 打上时间戳
-		(*(revBuffer.revBufferHangingPeriod[COM]))[buffer.bufferID] = time.Now().UnixMilli()
+		revBuffer.revBuffer[buffer.bufferID] = data
 		// 记录剩余帧数量
-		(*(revBuffer.revBufferResidue[COM]))[buffer.bufferID] = buffer.frameNum
+		revBuffer.revBufferResidue[buffer.bufferID] = buffer.frameNum
+	}
+	// 打上时间戳
+	revBuffer.revBufferHangingPeriod[buffer.bufferID] = time.Now().UnixMilli()
+	// 重复收到的数据帧直接丢弃
+	if (*data)[buffer.frameID] != nil {
+		return nil, false, nil
 	}
 	// 放入纯数据
-	pureDataLen := (int)(BytesToUint32((*buffer.data)[12:16]))
-	pureData := (*buffer.data)[16 : 16+pureDataLen]
-	(*data)[buffer.frameID] = &pureData
+	(*data)[buffer.frameID] = buffer.data
 	// 剩余的--
-	(*(revBuffer.revBufferResidue[COM]))[buffer.bufferID]--
-	if (*(revBuffer.revBufferResidue[COM]))[buffer.bufferID] == 0 {
-		//解析数据并发送到指定管道
-		rev := (*(revBuffer.revBuffer[COM]))[buffer.bufferID]
-		var revData []byte
-		for i := range *rev {
-			revData = append(revData, *(*rev)[i]...)
-		}
-		copy(revData, revData)
-		// 将数据发送到指定通道
-		message := ParseDataToSerialMessage(&revData)
-		channel := revBuffer.app.serialChannelByNodeModulesID[message.TargetModuleID]
-		// 开启数据缓冲删除倒计时
-		(*revBuffer.revBufferHangingPeriod[COM])[buffer.bufferID] = time.Now().UnixMilli()
-		// 将数据发送给需要的模块
-		*channel.ReceiveDataChannel <- message
-	}
-	return nil
+	revBuffer.revBufferResidue[buffer.bufferID]--
+	if revBuffer.revBufferResidue[buffer.bufferID] != 0 {
+		return nil, false, nil
+	}
+	// 拼接数据 缓冲区会保留到超时 以便丢弃之后重复到达的数据帧
+	revData := make([]byte, 0)
+	for i := range *data {
+		revData = append(revData, *(*data)[i]...)
+	}
+	return &revData, true, nil
 }
@@ -0,0 +1,107 @@
+package device
+
+import (
+	"hash/crc32"
+)
+
+// Checksum 数据帧帧尾的校验方式 初始化时和每个下位机协商
+type Checksum byte
+
+const (
+	// ChecksumOddParity 单字节奇校验 只检测奇数个位翻转 仅为兼容旧固件保留
+	ChecksumOddParity Checksum = iota
+	// ChecksumCRC16CCITT CRC-16-CCITT 多项式0x1021 初值0xFFFF
+	ChecksumCRC16CCITT
+	// ChecksumCRC32C CRC-32C 也就是Castagnoli多项式
+	ChecksumCRC32C
+)
+
+// CRC-32C的查找表
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Len 校验码在帧尾占用的长度
+// 传入：无
+// 传出：长度
+func (checksum Checksum) Len() int {
+	switch checksum {
+	case ChecksumCRC16CCITT:
+		return 2
+	case ChecksumCRC32C:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// String 校验方式的名称
+// 传入：无
+// 传出：名称
+func (checksum Checksum) String() string {
+	switch checksum {
+	case ChecksumOddParity:
+		return "OddParity"
+	case ChecksumCRC16CCITT:
+		return "CRC-16-CCITT"
+	case ChecksumCRC32C:
+		return "CRC-32C"
+	default:
+		return "Unknown"
+	}
+}
+
+// 是否是认识的校验方式
+// 传入：无
+// 传出：是否认识
+func (checksum Checksum) isKnown() bool {
+	return checksum <= ChecksumCRC32C
+}
+
+// 计算校验码 多字节的校验码高位在前
+// 传入：需要校验的数据
+// 传出：校验码
+func (checksum Checksum) sum(data []byte) []byte {
+	switch checksum {
+	case ChecksumCRC16CCITT:
+		crc := CRC16CCITT(data)
+		return []byte{byte(crc >> 8), byte(crc)}
+	case ChecksumCRC32C:
+		return Uint32ToBytes(crc32.Checksum(data, crc32cTable))
+	default:
+		return []byte{CalculateOddParity(&data)}
+	}
+}
+
+// 验证带有校验码的数据
+// 传入：数据 最后Len()个字节是校验码
+// 传出：是否通过校验
+func (checksum Checksum) verify(data []byte) bool {
+	if checksum == ChecksumOddParity {
+		return VerifyOddParity(&data)
+	}
+	end := len(data) - checksum.Len()
+	expected := checksum.sum(data[:end])
+	for i := range expected {
+		if data[end+i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CRC16CCITT 计算CRC-16-CCITT 多项式0x1021 初值0xFFFF 不反转
+// 传入：数据
+// 传出：校验码
+func CRC16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
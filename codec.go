@@ -0,0 +1,569 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+)
+
+/*
+ 数据帧的格式是 同步前导码[16位] 帧头版本[8位] 数据报编号[32位] 数据报帧号[32位] 数据报总帧数[32位] 数据报实际长度[32位](也就是这个数据报内要截取多少 只包含有效数据的长度) 数据[] 补0 校验码
+ 紧凑帧头时 帧头版本之后是 标志位[8位] 数据报编号[16位] 数据报帧号[16位] 数据报总帧数[16位] 数据报实际长度[16位]
+ 标志位的最低位表示该数据报被分片 只有一帧的数据报不分片 没有数据报帧号和数据报总帧数
+ 定长分帧时一帧总长度是固定的 由FrameCodec.FrameLen决定
+ COBS分帧时没有前导码和补0 帧头版本到校验码为止的内容经过COBS编码后以0x00结尾 一帧的长度随内容变化 内容最长为FrameLen-2
+ 校验码覆盖它之前的整个数据帧 长度由FrameCodec.Checksum决定 奇校验1字节 CRC-16 2字节 CRC-32C 4字节
+ 启用前向纠错时 帧头版本到校验码为止的内容经过Reed-Solomon编码 见fec.go 定长分帧时编码后不足FrameLen的部分补0
+ 帧头版本目前为2 布局发生变化时递增 解码时拒绝不认识的版本
+ 字节流错位时 接收方丢弃数据直到找到下一个前导码或者分帧符 并且该数据帧能够通过校验
+*/
+
+// FrameVersion 当前的数据帧帧头版本
+const FrameVersion byte = 2
+
+// 同步前导码 标记一个数据帧的开始
+var framePreamble = []byte{0xA5, 0x5A}
+
+// 帧头中前导码之后的长度 版本+4个uint32
+const frameFieldsLen = 17
+
+// 帧头长度 前导码+版本+4个uint32
+const frameHeaderLen = 2 + frameFieldsLen
+
+// 紧凑帧头中前导码之后的长度 版本+标志位+4个uint16
+const compactFieldsLen = 10
+
+// 不分片的紧凑帧头中前导码之后的长度 版本+标志位+2个uint16
+const compactSingleFieldsLen = 6
+
+// 紧凑帧头的数据长度字段只有16位 数据帧再长一帧承载的数据就会超出该字段的范围 其中2是前导码的长度
+const maxCompactFrameLen = 0xFFFF + 2 + compactSingleFieldsLen
+
+// 一个数据报最多的帧数 接收时按照帧头中的总帧数分配空间 需要限制
+const maxFrameNum = 1 << 16
+
+// 紧凑帧头标志位 数据报被分片
+const compactFlagFragmented byte = 0x01
+
+// HeaderProfile 帧头的布局 初始化时和每个下位机协商
+type HeaderProfile byte
+
+const (
+	// HeaderFull 完整帧头 每个字段32位
+	HeaderFull HeaderProfile = iota
+	// HeaderCompact 紧凑帧头 每个字段16位 不分片的数据报省略分片字段
+	HeaderCompact
+)
+
+// String 帧头布局的名称
+// 传入：无
+// 传出：名称
+func (header HeaderProfile) String() string {
+	switch header {
+	case HeaderFull:
+		return "Full"
+	case HeaderCompact:
+		return "Compact"
+	default:
+		return "Unknown"
+	}
+}
+
+// 是否是认识的帧头布局
+// 传入：无
+// 传出：是否认识
+func (header HeaderProfile) isKnown() bool {
+	return header <= HeaderCompact
+}
+
+// 数据帧解码错误的类型
+var (
+	// ErrFrameTooShort 数据帧短于帧头和帧尾
+	ErrFrameTooShort = errors.New("FrameTooShort")
+	// ErrFrameSync 数据帧不是以同步前导码开始
+	ErrFrameSync = errors.New("FrameSyncLost")
+	// ErrFrameLength 数据帧总长或者帧头中的长度字段不正确
+	ErrFrameLength = errors.New("BadFrameLength")
+	// ErrFrameVersion 不认识的帧头版本
+	ErrFrameVersion = errors.New("UnknownFrameVersion")
+	// ErrFrameChecksum 校验失败
+	ErrFrameChecksum = errors.New("FrameChecksumFailed")
+	// ErrFramePayloadTooLong 要编码的数据超过了一帧能承载的长度
+	ErrFramePayloadTooLong = errors.New("FramePayloadTooLong")
+	// ErrFrameFieldOverflow 帧头字段超出了紧凑帧头能表示的范围
+	ErrFrameFieldOverflow = errors.New("FrameFieldOverflow")
+	// ErrFrameHeader 通过校验的数据帧帧头中的字段超出范围 比如帧号不小于总帧数
+	ErrFrameHeader = errors.New("FrameHeaderOutOfRange")
+)
+
+// FrameError 数据帧编解码错误 可以通过errors.Is判断其类型
+type FrameError struct {
+	// 错误类型 也就是ErrFrameTooShort等
+	Kind error
+	// 出错的数据帧 帧头能够解析时不为nil 例如校验失败时可以据此要求重发 接收器只保留对齐位置上字段没有超出范围的帧头
+	Frame *Frame
+	// 详细信息
+	Detail string
+}
+
+// Error 实现error接口
+// 传入：无
+// 传出：错误信息
+func (err *FrameError) Error() string {
+	if err.Detail == "" {
+		return err.Kind.Error()
+	}
+	return err.Kind.Error() + ": " + err.Detail
+}
+
+// Unwrap 获取错误类型
+// 传入：无
+// 传出：错误类型
+func (err *FrameError) Unwrap() error {
+	return err.Kind
+}
+
+// Frame 单个数据帧 也就是数据报的一个分片
+type Frame struct {
+	// 数据报编号
+	BufferID uint32
+	// 数据报帧号
+	FrameID uint32
+	// 数据报总帧数
+	FrameNum uint32
+	// 该帧承载的数据
+	Payload []byte
+}
+
+// FrameCodec 数据帧编解码器 数据帧的布局只由它决定 所有的收发路径都通过它编解码
+type FrameCodec struct {
+	// 数据帧总长 COBS分帧时是数据帧长度的上限
+	FrameLen uint32
+	// 帧尾的校验方式
+	Checksum Checksum
+	// 分帧方式
+	Framing Framing
+	// 帧头布局
+	Header HeaderProfile
+	// 前向纠错方式
+	FEC FEC
+}
+
+// DefaultFrameCodec 获取默认的数据帧编解码器 数据帧总长为_const.PortLen
+// 校验方式为奇校验 分帧方式为定长 帧头为完整帧头 因为协商之前只能假设下位机是旧固件
+// 传入：无
+// 传出：编解码器
+func DefaultFrameCodec() *FrameCodec {
+	return &FrameCodec{FrameLen: _const.PortLen}
+}
+
+// 帧头中前导码之后的长度
+// 传入：数据报是否被分片
+// 传出：长度
+func (codec *FrameCodec) fieldsLen(isFragmented bool) int {
+	if codec.Header != HeaderCompact {
+		return frameFieldsLen
+	}
+	if isFragmented {
+		return compactFieldsLen
+	}
+	return compactSingleFieldsLen
+}
+
+// 一帧能够承载的数据长度
+// 传入：数据报是否被分片
+// 传出：长度
+func (codec *FrameCodec) payloadLen(isFragmented bool) uint32 {
+	payloadLen := codec.contentLen() - codec.fieldsLen(isFragmented) - codec.Checksum.Len()
+	if payloadLen < 0 {
+		return 0
+	}
+	return uint32(payloadLen)
+}
+
+// 帧头版本到校验码为止的内容的最大长度 也就是前向纠错编码之前的长度
+// 传入：无
+// 传出：长度
+func (codec *FrameCodec) contentLen() int {
+	return codec.FEC.dataLen(int(codec.FrameLen) - len(framePreamble))
+}
+
+// PayloadLen 分片时每个数据帧可以承载的数据长度
+// 传入：无
+// 传出：长度
+func (codec *FrameCodec) PayloadLen() uint32 {
+	return codec.payloadLen(true)
+}
+
+// 获取一个数据报分片时每帧承载的数据长度 紧凑帧头时能够放进一帧的数据报不分片 可以多承载分片字段的长度
+// 传入：数据报长度
+// 传出：长度
+func (codec *FrameCodec) fragmentLen(dataLen int) uint32 {
+	if uint32(dataLen) <= codec.payloadLen(false) {
+		return codec.payloadLen(false)
+	}
+	return codec.payloadLen(true)
+}
+
+// 获取一个数据报最多能分成的帧数 紧凑帧头的总帧数字段只有16位
+// 传入：无
+// 传出：总帧数上限
+func (codec *FrameCodec) frameNumLimit() uint32 {
+	if codec.Header == HeaderCompact {
+		return 0xFFFF
+	}
+	return maxFrameNum
+}
+
+// EncodeFrame 编码一个数据帧
+// 传入：数据帧
+// 传出：编码后的数据帧，错误
+func (codec *FrameCodec) EncodeFrame(frame *Frame) ([]byte, error) {
+	isFragmented := frame.FrameNum != 1 || frame.FrameID != 0
+	if uint32(len(frame.Payload)) > codec.payloadLen(isFragmented) {
+		return nil, &FrameError{Kind: ErrFramePayloadTooLong, Frame: frame, Detail: fmt.Sprintf("%d>%d", len(frame.Payload), codec.payloadLen(isFragmented))}
+	}
+	data := make([]byte, 0, codec.FrameLen)
+	if codec.Framing == FramingFixed {
+		data = append(data, framePreamble...)
+	}
+	data = append(data, FrameVersion)
+	if codec.Header == HeaderCompact {
+		if frame.BufferID > 0xFFFF || frame.FrameID > 0xFFFF || frame.FrameNum > 0xFFFF || len(frame.Payload) > 0xFFFF {
+			return nil, &FrameError{Kind: ErrFrameFieldOverflow, Frame: frame}
+		}
+		if isFragmented {
+			data = append(data, compactFlagFragmented)
+			data = append(data, uint16ToBytes(frame.BufferID)...)
+			data = append(data, uint16ToBytes(frame.FrameID)...)
+			data = append(data, uint16ToBytes(frame.FrameNum)...)
+		} else {
+			data = append(data, 0)
+			data = append(data, uint16ToBytes(frame.BufferID)...)
+		}
+		data = append(data, uint16ToBytes(uint32(len(frame.Payload)))...)
+	} else {
+		data = append(data, Uint32ToBytes(frame.BufferID)...)
+		data = append(data, Uint32ToBytes(frame.FrameID)...)
+		data = append(data, Uint32ToBytes(frame.FrameNum)...)
+		data = append(data, Uint32ToBytes(uint32(len(frame.Payload)))...)
+	}
+	data = append(data, frame.Payload...)
+	if codec.Framing == FramingCOBS {
+		data = append(data, codec.Checksum.sum(data)...)
+		return append(cobsEncode(codec.FEC.encode(data)), frameDelimiter), nil
+	}
+	// 补零
+	data = append(data, make([]byte, len(framePreamble)+codec.contentLen()-len(data)-codec.Checksum.Len())...)
+	data = append(data, codec.Checksum.sum(data)...)
+	if codec.FEC == FECNone {
+		return data, nil
+	}
+	coded := append(data[:len(framePreamble):len(framePreamble)], codec.FEC.encode(data[len(framePreamble):])...)
+	return append(coded, make([]byte, int(codec.FrameLen)-len(coded))...), nil
+}
+
+// DecodeFrame 解码一个数据帧 数据会被深拷贝
+// 校验失败时 返回的FrameError中带有解析出的帧头 以便要求重发
+// 传入：编码后的数据帧 COBS分帧时可以不包含结尾的分帧符
+// 传出：数据帧，错误
+func (codec *FrameCodec) DecodeFrame(data []byte) (*Frame, error) {
+	frame, _, err := codec.decodeFrame(data)
+	return frame, err
+}
+
+// 解码一个数据帧 并返回前向纠错纠正的字节数
+// 传入：编码后的数据帧
+// 传出：数据帧，纠正的字节数，错误
+func (codec *FrameCodec) decodeFrame(data []byte) (*Frame, int, error) {
+	if codec.Framing == FramingCOBS {
+		content, err := cobsDecode(bytes.TrimSuffix(data, []byte{frameDelimiter}))
+		if err != nil {
+			return nil, 0, &FrameError{Kind: ErrFrameSync, Detail: err.Error()}
+		}
+		content, corrected, err := codec.FEC.decode(content)
+		if err != nil {
+			return nil, 0, &FrameError{Kind: ErrFrameChecksum, Detail: err.Error()}
+		}
+		frame, err := codec.decodeContent(content, 0)
+		return frame, corrected, err
+	}
+	if len(data) < frameHeaderLen+codec.Checksum.Len() {
+		return nil, 0, &FrameError{Kind: ErrFrameTooShort, Detail: fmt.Sprintf("%d", len(data))}
+	}
+	if uint32(len(data)) != codec.FrameLen {
+		return nil, 0, &FrameError{Kind: ErrFrameLength, Detail: fmt.Sprintf("frame %d!=%d", len(data), codec.FrameLen)}
+	}
+	if !bytes.HasPrefix(data, framePreamble) {
+		return nil, 0, &FrameError{Kind: ErrFrameSync}
+	}
+	if codec.FEC == FECNone {
+		frame, err := codec.decodeContent(data, len(framePreamble))
+		return frame, 0, err
+	}
+	codedLen := codec.FEC.codedLen(codec.contentLen())
+	content, corrected, err := codec.FEC.decode(data[len(framePreamble) : len(framePreamble)+codedLen])
+	if err != nil {
+		return nil, 0, &FrameError{Kind: ErrFrameChecksum, Detail: err.Error()}
+	}
+	frame, err := codec.decodeContent(append(append([]byte{}, framePreamble...), content...), len(framePreamble))
+	return frame, corrected, err
+}
+
+// 解码帧头版本之后的内容 校验码覆盖整个数据
+// 传入：数据帧，帧头版本的位置
+// 传出：数据帧，错误
+func (codec *FrameCodec) decodeContent(data []byte, start int) (*Frame, error) {
+	header := data[start:]
+	// 帧头最短的情况 也就是不分片的紧凑帧头
+	if len(header) < codec.fieldsLen(false)+codec.Checksum.Len() {
+		return nil, &FrameError{Kind: ErrFrameTooShort, Detail: fmt.Sprintf("%d", len(header))}
+	}
+	if header[0] != FrameVersion {
+		return nil, &FrameError{Kind: ErrFrameVersion, Detail: fmt.Sprintf("%d", header[0])}
+	}
+	frame, fieldsLen, exactLength := codec.parseHeader(header)
+	if len(header) < fieldsLen+codec.Checksum.Len() {
+		return nil, &FrameError{Kind: ErrFrameTooShort, Detail: fmt.Sprintf("%d", len(header))}
+	}
+	payloadLen := len(header) - fieldsLen - codec.Checksum.Len()
+	if int(exactLength) > payloadLen {
+		return nil, &FrameError{Kind: ErrFrameLength, Frame: frame, Detail: fmt.Sprintf("payload %d>%d", exactLength, payloadLen)}
+	}
+	// COBS分帧没有补0 数据正好填满校验码之前的部分
+	if codec.Framing == FramingCOBS && int(exactLength) != payloadLen {
+		return nil, &FrameError{Kind: ErrFrameLength, Frame: frame, Detail: fmt.Sprintf("payload %d", exactLength)}
+	}
+	if !codec.Checksum.verify(data) {
+		return nil, &FrameError{Kind: ErrFrameChecksum, Frame: frame}
+	}
+	//深拷贝
+	frame.Payload = make([]byte, exactLength)
+	copy(frame.Payload, header[fieldsLen:fieldsLen+int(exactLength)])
+	return frame, nil
+}
+
+// 解析帧头版本之后的字段 调用前需要保证长度至少是最短的帧头
+// 传入：帧头版本开始的数据
+// 传出：只有帧头的数据帧，帧头长度，数据报实际长度
+func (codec *FrameCodec) parseHeader(header []byte) (*Frame, int, uint32) {
+	if codec.Header != HeaderCompact {
+		if len(header) < frameFieldsLen {
+			return &Frame{}, frameFieldsLen, 0
+		}
+		frame := &Frame{
+			BufferID: BytesToUint32(header[1:5]),
+			FrameID:  BytesToUint32(header[5:9]),
+			FrameNum: BytesToUint32(header[9:13]),
+		}
+		return frame, frameFieldsLen, BytesToUint32(header[13:17])
+	}
+	if header[1]&compactFlagFragmented == 0 {
+		frame := &Frame{BufferID: bytesToUint16(header[2:4]), FrameNum: 1}
+		return frame, compactSingleFieldsLen, bytesToUint16(header[4:6])
+	}
+	if len(header) < compactFieldsLen {
+		return &Frame{}, compactFieldsLen, 0
+	}
+	frame := &Frame{
+		BufferID: bytesToUint16(header[2:4]),
+		FrameID:  bytesToUint16(header[4:6]),
+		FrameNum: bytesToUint16(header[6:8]),
+	}
+	return frame, compactFieldsLen, bytesToUint16(header[8:10])
+}
+
+// 把uint32的低16位转为字节 高位在前
+// 传入：数
+// 传出：字节
+func uint16ToBytes(num uint32) []byte {
+	return []byte{byte(num >> 8), byte(num)}
+}
+
+// 把两个字节转为数 高位在前
+// 传入：字节
+// 传出：数
+func bytesToUint16(b []byte) uint32 {
+	return uint32(b[0])<<8 | uint32(b[1])
+}
+
+// 把消息信封切分编码为数据帧
+// 传入：消息信封，数据报编号
+// 传出：编码后的数据帧，错误
+func (codec *FrameCodec) encodeEnvelope(data []byte, bufferID uint32) ([][]byte, error) {
+	send := initSendDataBuffer(&data, bufferID, codec.fragmentLen(len(data)))
+	frames := make([][]byte, 0, send.frameNum)
+	for {
+		err, frameID, payload := send.nextDataFrame()
+		if err != nil {
+			return frames, nil
+		}
+		frame, err := codec.EncodeFrame(&Frame{
+			BufferID: send.bufferID,
+			FrameID:  frameID,
+			FrameNum: send.frameNum,
+			Payload:  *payload,
+		})
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// 数据帧接收器 从字节流中切分出数据帧并解码
+// 它是一个简单的状态机 对齐时逐帧解码 字节流错位或者损坏时丢弃数据 寻找下一个前导码重新对齐
+type frameReceiver struct {
+	// 编解码器
+	codec *FrameCodec
+	// 还不够一个数据帧的数据
+	buffer []byte
+	// 是否和字节流对齐
+	isSynced bool
+	// 统计 可以为nil
+	stats *linkStats
+}
+
+// 初始化数据帧接收器
+// 传入：编解码器，统计（可以为nil）
+// 传出：接收器
+func initFrameReceiver(codec *FrameCodec, stats *linkStats) *frameReceiver {
+	return &frameReceiver{
+		codec:    codec,
+		buffer:   make([]byte, 0, 2*codec.FrameLen),
+		isSynced: true,
+		stats:    stats,
+	}
+}
+
+// 放入从传输读取的数据
+// 传入：数据
+// 传出：无
+func (receiver *frameReceiver) push(data []byte) {
+	receiver.buffer = append(receiver.buffer, data...)
+}
+
+// 取出下一个数据帧
+// 传入：无
+// 传出：数据帧，是否取出了数据帧（为false时需要继续读取），解码错误
+func (receiver *frameReceiver) next() (*Frame, bool, error) {
+	if receiver.codec.Framing == FramingCOBS {
+		return receiver.nextDelimited()
+	}
+	return receiver.nextFixed()
+}
+
+// 取出下一个定长数据帧
+// 解码失败时只跳过当前的前导码 因为它可能是错位后在数据中误认的前导码
+// 所以只有对齐位置上的数据帧帧头可信 寻找状态下误认的数据帧不会据此要求重发
+// 传入：无
+// 传出：数据帧，是否取出了数据帧，解码错误
+func (receiver *frameReceiver) nextFixed() (*Frame, bool, error) {
+	// 前导码之前的数据都是错位或者损坏的
+	index := bytes.Index(receiver.buffer, framePreamble)
+	isAligned := index == 0 && receiver.isSynced
+	if index < 0 {
+		// 末尾可能是前导码的前半部分
+		keep := 0
+		if len(receiver.buffer) > 0 && receiver.buffer[len(receiver.buffer)-1] == framePreamble[0] {
+			keep = 1
+		}
+		receiver.discard(len(receiver.buffer) - keep)
+		return nil, false, nil
+	}
+	receiver.discard(index)
+	frameLen := int(receiver.codec.FrameLen)
+	if len(receiver.buffer) < frameLen {
+		return nil, false, nil
+	}
+	frame, corrected, err := receiver.codec.decodeFrame(receiver.buffer[:frameLen])
+	if err != nil {
+		receiver.discard(1)
+		return nil, true, untrustHeader(err, isAligned)
+	}
+	receiver.countCorrected(corrected)
+	receiver.buffer = append(receiver.buffer[:0], receiver.buffer[frameLen:]...)
+	receiver.isSynced = true
+	return frame, true, nil
+}
+
+// 取出下一个以分帧符结尾的数据帧
+// 解码失败时丢弃到分帧符为止的数据 下一个数据帧自然对齐
+// 传入：无
+// 传出：数据帧，是否取出了数据帧，解码错误
+func (receiver *frameReceiver) nextDelimited() (*Frame, bool, error) {
+	// COBS编码最多增加1/254 再加上开头的分组长度和分帧符
+	maxLen := int(receiver.codec.FrameLen) + int(receiver.codec.FrameLen)/254 + 2
+	for {
+		index := bytes.IndexByte(receiver.buffer, frameDelimiter)
+		if index < 0 {
+			// 一直没有分帧符 说明丢失了分帧符或者是噪声
+			if len(receiver.buffer) > maxLen {
+				receiver.discard(len(receiver.buffer))
+			}
+			return nil, false, nil
+		}
+		// 连续的分帧符之间没有数据
+		if index == 0 {
+			receiver.buffer = append(receiver.buffer[:0], receiver.buffer[1:]...)
+			continue
+		}
+		if index > maxLen {
+			receiver.discard(index + 1)
+			return nil, true, &FrameError{Kind: ErrFrameLength, Detail: fmt.Sprintf("frame %d>%d", index, maxLen)}
+		}
+		frame, corrected, err := receiver.codec.decodeFrame(receiver.buffer[:index])
+		if err != nil {
+			receiver.discard(index + 1)
+			// 分帧符之后总是对齐的
+			return nil, true, untrustHeader(err, true)
+		}
+		receiver.countCorrected(corrected)
+		receiver.buffer = append(receiver.buffer[:0], receiver.buffer[index+1:]...)
+		receiver.isSynced = true
+		return frame, true, nil
+	}
+}
+
+// 去掉解码错误中不可信的帧头 帧头不在对齐位置上或者字段超出范围时都可能是噪声
+// 传入：解码错误，数据帧是否在对齐位置上
+// 传出：解码错误
+func untrustHeader(err error, isAligned bool) error {
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Frame == nil {
+		return err
+	}
+	if !isAligned || checkFrameHeader(frameErr.Frame) != nil {
+		frameErr.Frame = nil
+	}
+	return err
+}
+
+// 记录前向纠错纠正的数据帧
+// 传入：纠正的字节数
+// 传出：无
+func (receiver *frameReceiver) countCorrected(corrected int) {
+	if corrected > 0 && receiver.stats != nil {
+		receiver.stats.correctedFrames.Add(1)
+		receiver.stats.correctedBytes.Add(uint64(corrected))
+	}
+}
+
+// 丢弃缓存开头的数据 从对齐状态进入寻找状态时记为一次重新同步
+// 传入：丢弃的长度
+// 传出：无
+func (receiver *frameReceiver) discard(n int) {
+	if n <= 0 {
+		return
+	}
+	if receiver.stats != nil {
+		if receiver.isSynced {
+			receiver.stats.resyncs.Add(1)
+		}
+		receiver.stats.discardedBytes.Add(uint64(n))
+	}
+	receiver.isSynced = false
+	receiver.buffer = append(receiver.buffer[:0], receiver.buffer[n:]...)
+}
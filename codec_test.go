@@ -0,0 +1,218 @@
+package device_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	device "github.com/238Studio/child-nodes-device-service"
+)
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	codec := device.DefaultFrameCodec()
+	frame := &device.Frame{BufferID: 3, FrameID: 1, FrameNum: 2, Payload: []byte{1, 2, 3, 0}}
+	data, err := codec.EncodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(len(data)) != codec.FrameLen || data[2] != device.FrameVersion {
+		t.Fatal("编码后的数据帧长度或版本不正确")
+	}
+	decoded, err := codec.DecodeFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BufferID != 3 || decoded.FrameID != 1 || decoded.FrameNum != 2 || !bytes.Equal(decoded.Payload, frame.Payload) {
+		t.Fatalf("数据帧往返后不一致: %+v", decoded)
+	}
+	// 解码结果不应当引用原始数据
+	data[19] = 0xff
+	if decoded.Payload[0] != 1 {
+		t.Fatal("解码时没有深拷贝")
+	}
+}
+
+func TestFrameCodecErrors(t *testing.T) {
+	codec := device.DefaultFrameCodec()
+	_, err := codec.EncodeFrame(&device.Frame{Payload: make([]byte, codec.PayloadLen()+1)})
+	if !errors.Is(err, device.ErrFramePayloadTooLong) {
+		t.Fatalf("过长的数据应当返回ErrFramePayloadTooLong: %v", err)
+	}
+	valid, _ := codec.EncodeFrame(&device.Frame{BufferID: 5, FrameID: 0, FrameNum: 1, Payload: []byte{7}})
+	if _, err = codec.DecodeFrame(valid[:10]); !errors.Is(err, device.ErrFrameTooShort) {
+		t.Fatalf("过短的数据帧应当返回ErrFrameTooShort: %v", err)
+	}
+	if _, err = codec.DecodeFrame(valid[:len(valid)-1]); !errors.Is(err, device.ErrFrameLength) {
+		t.Fatalf("长度不对的数据帧应当返回ErrFrameLength: %v", err)
+	}
+	if _, err = codec.DecodeFrame(append([]byte{0}, valid[1:]...)); !errors.Is(err, device.ErrFrameSync) {
+		t.Fatalf("没有前导码的数据帧应当返回ErrFrameSync: %v", err)
+	}
+	badVersion := append([]byte{}, valid...)
+	badVersion[2] = device.FrameVersion + 1
+	if _, err = codec.DecodeFrame(badVersion); !errors.Is(err, device.ErrFrameVersion) {
+		t.Fatalf("未知版本应当返回ErrFrameVersion: %v", err)
+	}
+	badLength := append([]byte{}, valid...)
+	badLength[15] = 0xff
+	if _, err = codec.DecodeFrame(badLength); !errors.Is(err, device.ErrFrameLength) {
+		t.Fatalf("超出数据帧的长度字段应当返回ErrFrameLength: %v", err)
+	}
+	// 翻转一位数据 帧头仍然完好 错误中应当带有帧头以便要求重发
+	badChecksum := append([]byte{}, valid...)
+	badChecksum[19] ^= 0x01
+	_, err = codec.DecodeFrame(badChecksum)
+	var frameErr *device.FrameError
+	if !errors.Is(err, device.ErrFrameChecksum) || !errors.As(err, &frameErr) {
+		t.Fatalf("校验失败应当返回ErrFrameChecksum: %v", err)
+	}
+	if frameErr.Frame == nil || frameErr.Frame.BufferID != 5 {
+		t.Fatal("校验失败时应当带有帧头")
+	}
+}
+
+func TestFrameCodecChecksums(t *testing.T) {
+	for _, checksum := range []device.Checksum{device.ChecksumOddParity, device.ChecksumCRC16CCITT, device.ChecksumCRC32C} {
+		codec := &device.FrameCodec{FrameLen: 64, Checksum: checksum}
+		payload := bytes.Repeat([]byte{0xa5}, int(codec.PayloadLen()))
+		data, err := codec.EncodeFrame(&device.Frame{FrameNum: 1, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := codec.DecodeFrame(data)
+		if err != nil || !bytes.Equal(decoded.Payload, payload) {
+			t.Fatalf("%s: 数据帧往返后不一致 %v", checksum, err)
+		}
+		// 翻转两位 奇校验检测不到 CRC应当检测到
+		data[20] ^= 0x01
+		data[30] ^= 0x80
+		_, err = codec.DecodeFrame(data)
+		if checksum != device.ChecksumOddParity && !errors.Is(err, device.ErrFrameChecksum) {
+			t.Fatalf("%s: 没有检测到两位翻转", checksum)
+		}
+	}
+}
+
+func TestCRC16CCITT(t *testing.T) {
+	// CRC-16/CCITT-FALSE的标准检验值
+	if crc := device.CRC16CCITT([]byte("123456789")); crc != 0x29b1 {
+		t.Fatalf("CRC-16-CCITT计算错误: %04x", crc)
+	}
+}
+
+func TestFrameCodecCOBS(t *testing.T) {
+	codec := &device.FrameCodec{FrameLen: 512, Checksum: device.ChecksumCRC16CCITT, Framing: device.FramingCOBS}
+	payloads := [][]byte{
+		{},
+		{0, 0, 0},
+		{6, 0, 1, 2, 3, 0},
+		bytes.Repeat([]byte{0x11}, 300),
+		bytes.Repeat([]byte{0x00}, int(codec.PayloadLen())),
+	}
+	for _, payload := range payloads {
+		data, err := codec.EncodeFrame(&device.Frame{BufferID: 1, FrameNum: 1, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 分帧符只出现在结尾
+		if bytes.IndexByte(data, 0) != len(data)-1 {
+			t.Fatal("COBS编码后的数据帧中出现了分帧符")
+		}
+		decoded, err := codec.DecodeFrame(data)
+		if err != nil || !bytes.Equal(decoded.Payload, payload) {
+			t.Fatalf("COBS数据帧往返后不一致: %d %v", len(payload), err)
+		}
+	}
+	// 数据帧和其内容一样长 不补零
+	small, _ := codec.EncodeFrame(&device.Frame{FrameNum: 1, Payload: []byte{1, 2, 3, 4, 5, 6}})
+	if len(small) > 32 {
+		t.Fatalf("6字节数据的COBS数据帧过长: %d", len(small))
+	}
+	small[5] ^= 0x40
+	if _, err := codec.DecodeFrame(small); err == nil {
+		t.Fatal("损坏的COBS数据帧应当返回错误")
+	}
+}
+
+func TestFrameCodecCompactHeader(t *testing.T) {
+	full := &device.FrameCodec{FrameLen: 64, Checksum: device.ChecksumCRC16CCITT, Framing: device.FramingCOBS}
+	compact := &device.FrameCodec{FrameLen: 64, Checksum: device.ChecksumCRC16CCITT, Framing: device.FramingCOBS, Header: device.HeaderCompact}
+	frames := []*device.Frame{
+		{BufferID: 0x1234, FrameNum: 1, Payload: []byte{1, 2, 3}},
+		{BufferID: 0xFFFF, FrameID: 2, FrameNum: 3, Payload: []byte{4, 5}},
+	}
+	for _, frame := range frames {
+		data, err := compact.EncodeFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := compact.DecodeFrame(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.BufferID != frame.BufferID || decoded.FrameID != frame.FrameID || decoded.FrameNum != frame.FrameNum || !bytes.Equal(decoded.Payload, frame.Payload) {
+			t.Fatalf("紧凑帧头往返后不一致: %+v", decoded)
+		}
+	}
+	// 不分片的数据报省略分片字段 帧头比完整帧头短11字节
+	fullData, _ := full.EncodeFrame(frames[0])
+	compactData, _ := compact.EncodeFrame(frames[0])
+	if len(fullData)-len(compactData) != 11 {
+		t.Fatalf("紧凑帧头的开销不正确: %d %d", len(fullData), len(compactData))
+	}
+	if compact.PayloadLen() <= full.PayloadLen() {
+		t.Fatal("紧凑帧头的数据帧应当承载更多数据")
+	}
+	if _, err := compact.EncodeFrame(&device.Frame{BufferID: 0x10000, FrameNum: 1}); !errors.Is(err, device.ErrFrameFieldOverflow) {
+		t.Fatalf("超出16位的字段应当返回ErrFrameFieldOverflow: %v", err)
+	}
+	// 定长分帧同样可以使用紧凑帧头
+	fixed := &device.FrameCodec{FrameLen: 32, Checksum: device.ChecksumCRC32C, Header: device.HeaderCompact}
+	data, err := fixed.EncodeFrame(&device.Frame{BufferID: 9, FrameNum: 1, Payload: bytes.Repeat([]byte{0xa5}, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := fixed.DecodeFrame(data); err != nil || len(decoded.Payload) != 20 {
+		t.Fatalf("定长分帧的紧凑帧头往返后不一致: %v", err)
+	}
+}
+
+func TestFrameCodecFEC(t *testing.T) {
+	plain := &device.FrameCodec{FrameLen: 128, Checksum: device.ChecksumCRC16CCITT}
+	for _, fec := range []device.FEC{device.FECReedSolomon8, device.FECReedSolomon16} {
+		codec := &device.FrameCodec{FrameLen: 128, Checksum: device.ChecksumCRC16CCITT, FEC: fec}
+		if codec.PayloadLen() != plain.PayloadLen()-uint32(fec.ParityLen()) {
+			t.Fatalf("%s: 纠错后承载的数据长度不正确 %d", fec, codec.PayloadLen())
+		}
+		payload := bytes.Repeat([]byte{1, 2, 3}, int(codec.PayloadLen())/3)
+		data, err := codec.EncodeFrame(&device.Frame{BufferID: 4, FrameNum: 1, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint32(len(data)) != codec.FrameLen {
+			t.Fatalf("%s: 数据帧长度不正确 %d", fec, len(data))
+		}
+		// 前导码之后的内容中最多可以纠正ParityLen()/2个字节
+		for i := 0; i < fec.ParityLen()/2; i++ {
+			data[3+i*13] ^= 0x5a
+		}
+		decoded, err := codec.DecodeFrame(data)
+		if err != nil || decoded.BufferID != 4 || !bytes.Equal(decoded.Payload, payload) {
+			t.Fatalf("%s: 没有纠正数据帧中的错误 %v", fec, err)
+		}
+		data[100] ^= 0x5a
+		data[101] ^= 0x5a
+		if _, err = codec.DecodeFrame(data); !errors.Is(err, device.ErrFrameChecksum) {
+			t.Fatalf("%s: 超出纠错能力时应当返回ErrFrameChecksum %v", fec, err)
+		}
+		// COBS分帧时在COBS编码之前纠错编码
+		cobs := &device.FrameCodec{FrameLen: 512, Checksum: device.ChecksumCRC32C, Framing: device.FramingCOBS, FEC: fec}
+		data, err = cobs.EncodeFrame(&device.Frame{BufferID: 5, FrameNum: 1, Payload: bytes.Repeat([]byte{0, 7}, 200)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err = cobs.DecodeFrame(data); err != nil || len(decoded.Payload) != 400 {
+			t.Fatalf("%s: COBS分帧纠错编码往返后不一致 %v", fec, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package device
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+// Compression 消息信封中数据的压缩算法 初始化时和每个下位机协商双方都支持的算法
+type Compression byte
+
+const (
+	// CompressionNone 不压缩 所有下位机都支持
+	CompressionNone Compression = iota
+	// CompressionFlate DEFLATE 也就是RFC 1951
+	CompressionFlate
+)
+
+// String 压缩算法的名称
+// 传入：无
+// 传出：名称
+func (compression Compression) String() string {
+	switch compression {
+	case CompressionNone:
+		return "None"
+	case CompressionFlate:
+		return "Flate"
+	default:
+		return "Unknown"
+	}
+}
+
+// 是否是认识的压缩算法
+// 传入：无
+// 传出：是否认识
+func (compression Compression) isKnown() bool {
+	return compression <= CompressionFlate
+}
+
+// 解压后的数据长度上限 防止损坏或者恶意的数据解压出过多的数据
+const maxDecompressedLen = 1 << 24
+
+// CompressionConfig 某个模块的讯息压缩配置
+type CompressionConfig struct {
+	// 压缩算法 为CompressionNone时不压缩
+	Algorithm Compression
+	// 压缩阈值 讯息数据不短于该长度时才压缩
+	Threshold int
+}
+
+// SetCompression 设置发往某个模块的讯息的压缩配置 只有下位机在初始化时声明支持该算法才会压缩
+// 压缩后没有变短的讯息仍然不压缩发送
+// 传入：模块ID，压缩配置
+// 传出：无
+func (app *SerialApp) SetCompression(moduleID uint32, config CompressionConfig) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.compressionByModule[moduleID] = config
+}
+
+// 选择发往某个下位机某个模块的讯息使用的压缩算法 在该下位机的端口线程中调用
+// 传入：下位机，模块ID，数据长度
+// 传出：压缩算法
+func (app *SerialApp) chooseCompression(device *SerialDevice, moduleID uint32, dataLen int) Compression {
+	app.mu.Lock()
+	config, ok := app.compressionByModule[moduleID]
+	app.mu.Unlock()
+	if !ok || config.Algorithm == CompressionNone || dataLen < config.Threshold {
+		return CompressionNone
+	}
+	if device.profile == nil {
+		return CompressionNone
+	}
+	for _, compression := range device.profile.Compressions {
+		if compression == config.Algorithm {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+// 压缩数据
+// 传入：数据
+// 传出：压缩后的数据，错误
+func (compression Compression) compress(data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		var compressed bytes.Buffer
+		writer, err := flate.NewWriter(&compressed, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	default:
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("UnknownCompression"))
+	}
+}
+
+// 解压数据
+// 传入：压缩后的数据
+// 传出：数据，错误
+func (compression Compression) decompress(data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(reader, maxDecompressedLen+1))
+		if err != nil {
+			return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("BadCompressedData"))
+		}
+		if len(decompressed) > maxDecompressedLen {
+			return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("DecompressedTooLong"))
+		}
+		return decompressed, nil
+	default:
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("UnknownCompression"))
+	}
+}
@@ -0,0 +1,176 @@
+package device
+
+import (
+	"context"
+	"errors"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 同步发送把讯息装入每个拥有目标模块的下位机的发送缓存 然后等待每个下位机的结果
+ 协商出逐帧确认的下位机在所有数据帧都被确认后完成 不确认的旧固件只能在所有数据帧都写入端口后完成
+ 发送仍然由端口线程轮转进行 所以需要先StartSendChannel 否则只能等到ctx结束
+ ctx结束时还没有结果的下位机记为超时 已经装入发送缓存的讯息仍然会继续发送
+*/
+
+// ErrDeliveryFailed 至少一个下位机没有收到讯息 每个下位机的结果见DeliveryReport
+var ErrDeliveryFailed = errors.New("DeliveryFailed")
+
+// DeliveryStatus 讯息在一个下位机上的结果
+type DeliveryStatus int
+
+const (
+	// DeliveryAcked 所有数据帧都被下位机确认
+	DeliveryAcked DeliveryStatus = iota
+	// DeliverySent 所有数据帧都已经写入端口 下位机没有协商逐帧确认 无法知道是否收到
+	DeliverySent
+	// DeliveryFailed 没有装入发送缓存 写入端口失败 重发次数达到上限 或者在有结果之前被移出了发送缓存
+	DeliveryFailed
+	// DeliveryTimeout ctx结束时还没有结果
+	DeliveryTimeout
+)
+
+// String 结果的名称
+// 传入：无
+// 传出：名称
+func (status DeliveryStatus) String() string {
+	switch status {
+	case DeliveryAcked:
+		return "Acked"
+	case DeliverySent:
+		return "Sent"
+	case DeliveryFailed:
+		return "Failed"
+	case DeliveryTimeout:
+		return "Timeout"
+	default:
+		return "Unknown"
+	}
+}
+
+// DeliveryOutcome 讯息在一个下位机上的结果
+type DeliveryOutcome struct {
+	// 下位机COM
+	COM string
+	// 结果
+	Status DeliveryStatus
+	// 数据报编号 没有装入发送缓存时为0
+	BufferID uint32
+	// 失败或者超时的原因
+	Err error
+}
+
+// DeliveryReport 同步发送的结果
+type DeliveryReport struct {
+	// 目标模块
+	ModuleID uint32
+	// 目标功能
+	Function string
+	// 每个拥有目标模块的下位机的结果
+	Outcomes []DeliveryOutcome
+}
+
+// IsDelivered 是否所有下位机都已经确认或者写入
+// 传入：无
+// 传出：是否送达
+func (report *DeliveryReport) IsDelivered() bool {
+	for _, outcome := range report.Outcomes {
+		if outcome.Status != DeliveryAcked && outcome.Status != DeliverySent {
+			return false
+		}
+	}
+	return true
+}
+
+// 记录数据报的结果
+// 传入：错误 为nil时成功，是否逐帧确认
+// 传出：无
+func (outcome *DeliveryOutcome) finish(err error, isARQ bool) {
+	if err != nil {
+		outcome.Status = DeliveryFailed
+		outcome.Err = err
+	} else if isARQ {
+		outcome.Status = DeliveryAcked
+	} else {
+		outcome.Status = DeliverySent
+	}
+}
+
+// 通知同步发送的调用者数据报的结果 只通知一次 管道有一个缓冲 不会阻塞端口线程
+// 传入：错误 为nil时成功
+// 传出：无
+func (sendDataBuffer *SendDataBuffer) finish(err error) {
+	if sendDataBuffer.done == nil {
+		return
+	}
+	sendDataBuffer.done <- err
+	sendDataBuffer.done = nil
+}
+
+// Send 同步发送一条讯息到所有拥有该模块的下位机 阻塞直到每个下位机都确认了整个数据报 或者ctx结束
+// 传入：ctx，目标模块，目标功能，数据
+// 传出：每个下位机的结果，错误（没有下位机拥有该模块 或者至少一个下位机没有送达时为ErrDeliveryFailed）
+func (app *SerialApp) Send(ctx context.Context, moduleID uint32, function string, data []byte) (*DeliveryReport, error) {
+	report := &DeliveryReport{ModuleID: moduleID, Function: function}
+	targets, err := app.sendTargets(moduleID)
+	if err != nil {
+		return report, err
+	}
+	report.Outcomes = make([]DeliveryOutcome, len(targets))
+	dones := make([]chan error, len(targets))
+	isARQ := make([]bool, len(targets))
+	for i, device := range targets {
+		outcome := &report.Outcomes[i]
+		outcome.COM = device.COM
+		done := make(chan error, 1)
+		err := device.actor.call(func() error {
+			send, err := app.readyToSendToDevice(nil, moduleID, function, device, &data)
+			if err != nil {
+				return err
+			}
+			send.done = done
+			outcome.BufferID = send.bufferID
+			isARQ[i] = send.isARQ
+			return nil
+		})
+		if err != nil {
+			app.publish(Event{Kind: EventSendFailed, COM: device.COM, ModuleID: moduleID}, _const.CommonException, err)
+			outcome.Status = DeliveryFailed
+			outcome.Err = err
+			continue
+		}
+		dones[i] = done
+	}
+	for i, device := range targets {
+		if dones[i] == nil {
+			continue
+		}
+		outcome := &report.Outcomes[i]
+		// 前一个下位机等到ctx结束时 已经有结果的下位机仍然记录其结果
+		select {
+		case err := <-dones[i]:
+			outcome.finish(err, isARQ[i])
+			continue
+		default:
+		}
+		select {
+		case err := <-dones[i]:
+			outcome.finish(err, isARQ[i])
+		case <-device.actor.done:
+			outcome.Status = DeliveryFailed
+			outcome.Err = util.NewError(_const.TrivialException, _const.Device, ErrPortStopped)
+		case <-app.ctx.Done():
+			outcome.Status = DeliveryFailed
+			outcome.Err = util.NewError(_const.TrivialException, _const.Device, ErrAppClosed)
+		case <-ctx.Done():
+			outcome.Status = DeliveryTimeout
+			outcome.Err = ctx.Err()
+		}
+	}
+	if !report.IsDelivered() {
+		return report, util.NewError(_const.CommonException, _const.Device, ErrDeliveryFailed)
+	}
+	return report, nil
+}
@@ -1,32 +1,1340 @@
 package device_test
 
 import (
-	_const "github.com/238Studio/child-nodes-assist/const"
-	device "github.com/238Studio/child-nodes-device-service"
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+	device "github.com/238Studio/child-nodes-device-service"
+	"github.com/tarm/serial"
 )
 
+// 通过内存管道连接一个虚拟下位机 并完成握手
+func initVirtualDevice(t *testing.T, COM string, modules []uint32) (*device.SerialApp, *device.VirtualDevice) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	return serialApp, attachVirtualDevice(t, serialApp, COM, modules)
+}
+
+// 在已有的SerialApp上通过内存管道连接一个虚拟下位机 并完成握手
+func attachVirtualDevice(t *testing.T, serialApp *device.SerialApp, COM string, modules []uint32) *device.VirtualDevice {
+	pipe := device.NewPipe(COM)
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), modules)
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	err := serialApp.AutoInitPerDeviceWithTransport(COM, pipe.Opener())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := virtualDevice.DeviceID(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("虚拟下位机没有收到握手")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return virtualDevice
+}
+
 func TestName(t *testing.T) {
-	// 测试硬件连接器
-	println("硬件连接器")
-	Baud := 9600
-	serialApp := device.InitSerialApp(Baud, time.Second, 3, 1000, 1000)
-	serialApp.AutoInitAllDevices()
+	// 测试硬件连接器 使用虚拟下位机代替真实串口
+	_, virtualDevice := initVirtualDevice(t, "COM5", []uint32{_const.SensorModule})
+	id, _ := virtualDevice.DeviceID()
+	if id != 5 {
+		t.Fatalf("下位机编号错误: %d", id)
+	}
+}
+
+func TestLinuxDevicePath(t *testing.T) {
+	serialApp, usb := initVirtualDevice(t, "/dev/ttyUSB0", nil)
+	// 末尾数字相同的路径不能得到相同的编号
+	acm := attachVirtualDevice(t, serialApp, "/dev/ttyACM0", nil)
+	byID := attachVirtualDevice(t, serialApp, "/dev/serial/by-id/usb-STM32_Virtual_ComPort-if00", nil)
+	paths := []string{"/dev/ttyUSB0", "/dev/ttyACM0", "/dev/serial/by-id/usb-STM32_Virtual_ComPort-if00"}
+	seen := make(map[byte]bool)
+	for i, virtualDevice := range []*device.VirtualDevice{usb, acm, byID} {
+		id, _ := virtualDevice.DeviceID()
+		if seen[id] {
+			t.Fatalf("编号重复: %d", id)
+		}
+		seen[id] = true
+		COM, ok := serialApp.GetCOMByDeviceID(id)
+		if !ok || COM != paths[i] {
+			t.Fatalf("编号%d没有映射回%s: %s", id, paths[i], COM)
+		}
+	}
+	serialApp.RemoveDeviceFromSerialApp("/dev/ttyACM0")
+	if _, ok := serialApp.GetDeviceID("/dev/ttyACM0"); ok {
+		t.Fatal("移除下位机后编号没有被释放")
+	}
+}
+
+func TestLineConfigOverride(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	config := serialApp.DefaultLineConfig()
+	config.Baud = 921600
+	serialApp.SetLineConfigForPort("COM2", config)
+	attachVirtualDevice(t, serialApp, "COM2", nil)
+	attachVirtualDevice(t, serialApp, "COM3", nil)
+	if info, _ := serialApp.GetTransportInfo("COM2"); info.Baud != 921600 {
+		t.Fatalf("按串口路径覆盖的波特率没有生效: %d", info.Baud)
+	}
+	if info, _ := serialApp.GetTransportInfo("COM3"); info.Baud != 9600 {
+		t.Fatalf("默认波特率错误: %d", info.Baud)
+	}
+	// 内存管道不支持硬件流控
+	config.FlowControl = device.FlowControlRTSCTS
+	if err := serialApp.SetLineConfig("COM3", config); err == nil {
+		t.Fatal("不支持流控的传输应当返回错误")
+	}
+}
+
+func TestLineConfigOverrideConcurrent(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	config := serialApp.DefaultLineConfig()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			serialApp.SetLineConfigForPort("COM35", config)
+			serialApp.SetLineConfigForUSB("0483", "5740", config)
+		}
+	}()
+	// 在-race下检查覆盖配置和自动初始化同时进行
+	attachVirtualDevice(t, serialApp, "COM35", nil)
+	<-done
+}
+
+func TestSetLineConfigWhileListening(t *testing.T) {
+	serialApp, virtualDevice := initVirtualDevice(t, "COM34", nil)
+	events, _ := serialApp.SubscribeEvents(16)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartAllListenMessage()
+	config := serialApp.DefaultLineConfig()
+	for i := 0; i < 20; i++ {
+		config.ReadTimeout = time.Duration(5+i%2*5) * time.Millisecond
+		if err := serialApp.SetLineConfig("COM34", config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重新打开端口之后监听没有结束 仍然能收到下位机的讯息
+	if err := virtualDevice.SendMessage(&device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Ping", Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if message.TargetFunction != "Ping" {
+			t.Fatalf("收到的讯息错误: %+v", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("修改线路配置后监听中断")
+	}
+	for {
+		select {
+		case event := <-events:
+			if event.Kind == device.EventListenStopped {
+				t.Fatalf("修改线路配置不应当结束监听: %+v", event)
+			}
+			continue
+		default:
+		}
+		break
+	}
+}
+
+func TestBaudDetection(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetBaudDetection([]int{9600, 57600, 115200, 921600}, 500*time.Millisecond)
+	pipe := device.NewPipe("/dev/ttyUSB0")
+	pipe.SetBaud(115200)
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10, 0x11})
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	err := serialApp.AutoInitPerDeviceWithTransport("/dev/ttyUSB0", pipe.Opener())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := serialApp.GetLineConfig("/dev/ttyUSB0"); config.Baud != 115200 {
+		t.Fatalf("识别到的波特率没有保存: %d", config.Baud)
+	}
+	if modules, _ := serialApp.GetDeviceSubModules("/dev/ttyUSB0"); len(modules) != 2 || modules[1] != 0x11 {
+		t.Fatalf("功能模块没有注册: %v", modules)
+	}
+	// 没有任何候选波特率能够通讯时返回错误
+	silent := device.NewPipe("/dev/ttyUSB1")
+	silent.SetBaud(38400)
+	if err := serialApp.AutoInitPerDeviceWithTransport("/dev/ttyUSB1", silent.Opener()); err == nil {
+		t.Fatal("没有识别到波特率时应当返回错误")
+	}
+	if config, _ := serialApp.GetLineConfig("/dev/ttyUSB1"); config.Baud != 9600 {
+		t.Fatalf("识别失败后没有恢复原来的波特率: %d", config.Baud)
+	}
+}
+
+func TestBaudDetectionBlockingRead(t *testing.T) {
+	// 读取等待时间为0时 读取没有应答的端口会一直阻塞
+	serialApp := device.InitSerialApp(9600, 0, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetBaudDetection([]int{9600, 115200}, 100*time.Millisecond)
+	silent := device.NewPipe("/dev/ttyUSB2")
+	done := make(chan error, 1)
+	go func() { done <- serialApp.AutoInitPerDeviceWithTransport("/dev/ttyUSB2", silent.Opener()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("没有识别到波特率时应当返回错误")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有应答的端口让波特率识别一直阻塞")
+	}
+	if config, _ := serialApp.GetLineConfig("/dev/ttyUSB2"); config.Baud != 9600 || config.ReadTimeout != 0 {
+		t.Fatalf("识别失败后没有恢复原来的线路配置: %+v", config)
+	}
+}
+
+func TestSendToVirtualDevice(t *testing.T) {
+	serialApp, virtualDevice := initVirtualDevice(t, "COM1", []uint32{0x10})
+	serialApp.RegisterSubModulesWithDevice([]uint32{0x10}, "COM1")
+	if errs := serialApp.StartAllSendChannels(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	serialApp.StartSendMessage(0x20)
+	// 超过一帧的数据 需要分片发送
+	data := bytes.Repeat([]byte{0x5a, 0x01, 0x00}, 400)
+	*channel.SendDataChannel <- &device.SerialMessage{
+		TargetModuleID: 0x10,
+		TargetFunction: "Move",
+		Data:           data,
+	}
+	select {
+	case message := <-virtualDevice.Received():
+		if message.TargetModuleID != 0x10 || message.TargetFunction != "Move" {
+			t.Fatalf("消息信封错误: %d %s", message.TargetModuleID, message.TargetFunction)
+		}
+		if !bytes.Equal(message.Data, data) {
+			t.Fatalf("重组后的数据不一致: 长度%d 期望%d", len(message.Data), len(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("虚拟下位机没有收到数据")
+	}
+}
+
+func TestAutoInitRegistersModules(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.StartAutoInit()
+	attachVirtualDevice(t, serialApp, "COM7", []uint32{_const.SensorModule, 0x10})
+	serialApp.StartAllListenMessage()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		modules, _ := serialApp.GetDeviceSubModules("COM7")
+		if len(modules) == 2 && modules[1] == 0x10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("初始化应答没有注册功能模块: %v", modules)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoundTripWithVirtualDevice(t *testing.T) {
+	serialApp, virtualDevice := initVirtualDevice(t, "COM8", []uint32{0x10})
+	serialApp.RegisterSubModulesWithDevice([]uint32{0x10}, "COM8")
+	// 下位机的0x10模块收到Ping后 回复给上位机的0x20模块
+	virtualDevice.Handle(0x10, "Ping", func(msg *device.SerialMessage) []*device.SerialMessage {
+		return []*device.SerialMessage{{TargetModuleID: 0x20, TargetFunction: "Pong", Data: msg.Data}}
+	})
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	serialApp.StartSendMessage(0x20)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	serialApp.StartAllListenMessage()
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 200)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Ping", Data: data}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if message.TargetFunction != "Pong" || !bytes.Equal(message.Data, data) {
+			t.Fatal("回复的讯息不一致")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有收到下位机的回复")
+	}
+}
+
+// 等待和某个下位机的校验方式协商完成
+func waitChecksum(t *testing.T, serialApp *device.SerialApp, virtualDevice *device.VirtualDevice, COM string, checksum device.Checksum) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := serialApp.GetDeviceChecksum(COM)
+		if got == checksum && virtualDevice.Checksum() == checksum {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("校验方式协商错误: 上位机%s 下位机%s 期望%s", got, virtualDevice.Checksum(), checksum)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChecksumNegotiation(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM9", []uint32{0x10})
+	serialApp.StartAllListenMessage()
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	waitChecksum(t, serialApp, virtualDevice, "COM9", device.ChecksumCRC32C)
+	// 协商之后双方使用CRC-32C收发
+	virtualDevice.SetEcho(true)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	data := bytes.Repeat([]byte{9, 8, 7}, 300)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Echo", Data: data}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, data) {
+			t.Fatal("回显的讯息不一致")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有收到下位机的回显")
+	}
+}
+
+func TestChecksumNegotiationLegacy(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetChecksums(device.ChecksumCRC16CCITT, device.ChecksumOddParity)
+	serialApp.StartAutoInit()
+	// 没有声明能力的旧固件只能使用奇校验
+	pipe := device.NewPipe("COM10")
+	legacy := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	legacy.SetLegacy()
+	legacy.Start()
+	t.Cleanup(legacy.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM10", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM10", time.Now().UnixMilli())
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if modules, _ := serialApp.GetDeviceSubModules("COM10"); len(modules) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("旧固件没有完成初始化")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitChecksum(t, serialApp, legacy, "COM10", device.ChecksumOddParity)
+	// 优先级最高的共同校验方式
+	modern := attachVirtualDevice(t, serialApp, "COM11", nil)
+	go serialApp.ListenMessagePerDevice("COM11", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, modern, "COM11", device.ChecksumCRC16CCITT)
+}
+
+func TestResyncAfterCorruption(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	pipe := device.NewPipe("COM12")
+	deviceEnd := pipe.DeviceEnd(10 * time.Millisecond)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM12", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	go serialApp.ListenMessagePerDevice("COM12", time.Now().UnixMilli())
+	codec := device.DefaultFrameCodec()
+	encode := func(bufferID uint32, data []byte) []byte {
+		envelope, _ := device.EncodeSerialMessage(&device.SerialMessage{TargetModuleID: 0x20, TargetFunction: "Status", Data: data})
+		frame, err := codec.EncodeFrame(&device.Frame{BufferID: bufferID, FrameNum: 1, Payload: envelope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	// 噪声 丢了一个字节的数据帧 之后是完好的数据帧
+	stream := []byte{0x01, 0xa5, 0x02}
+	broken := encode(1, []byte{1})
+	stream = append(stream, append(broken[:40], broken[41:]...)...)
+	stream = append(stream, encode(2, []byte{2})...)
+	if _, err := deviceEnd.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, []byte{2}) {
+			t.Fatalf("重新同步后收到了错误的讯息: %v", message.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("字节流错位后没有重新同步")
+	}
+	stats, err := serialApp.GetLinkStats("COM12")
+	if err != nil || stats.Resyncs == 0 || stats.DiscardedBytes == 0 {
+		t.Fatalf("重新同步没有被统计: %+v", stats)
+	}
+}
+
+func TestCOBSFramingNegotiation(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	config := serialApp.DefaultLineConfig()
+	config.Framing = device.FramingCOBS
+	serialApp.SetLineConfigForPort("COM13", config)
+	serialApp.SetLineConfigForPort("COM14", config)
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM13", []uint32{0x10})
+	go serialApp.ListenMessagePerDevice("COM13", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, virtualDevice, "COM13", device.ChecksumCRC32C)
+	if framing, _ := serialApp.GetDeviceFraming("COM13"); framing != device.FramingCOBS || virtualDevice.Framing() != device.FramingCOBS {
+		t.Fatalf("分帧方式协商错误: 上位机%s 下位机%s", framing, virtualDevice.Framing())
+	}
+	// 分片和重组不受分帧方式影响
+	virtualDevice.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	for _, data := range [][]byte{{1, 0, 2, 0, 0, 3}, bytes.Repeat([]byte{0, 0xff, 0}, 500)} {
+		*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Echo", Data: data}
+		select {
+		case message := <-*channel.ReceiveDataChannel:
+			if !bytes.Equal(message.Data, data) {
+				t.Fatal("COBS分帧回显的讯息不一致")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("COBS分帧没有收到下位机的回显")
+		}
+	}
+	// 下位机不支持COBS时使用定长分帧
+	fixedOnly := device.NewPipe("COM14")
+	fixed := device.InitVirtualDevice(fixedOnly.DeviceEnd(10*time.Millisecond), nil)
+	fixed.SetFramings(device.FramingFixed)
+	fixed.Start()
+	t.Cleanup(fixed.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM14", fixedOnly.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM14", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, fixed, "COM14", device.ChecksumCRC32C)
+	if framing, _ := serialApp.GetDeviceFraming("COM14"); framing != device.FramingFixed {
+		t.Fatalf("下位机不支持COBS时应当使用定长分帧: %s", framing)
+	}
+}
+
+func TestMTUNegotiation(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetMTULimit(1024)
+	serialApp.StartAutoInit()
+	// 小MCU的FIFO只有64字节 大板子可以接受比上位机上限更长的数据帧
+	small := attachVirtualDeviceWithMTU(t, serialApp, "COM15", []uint32{0x10}, 64)
+	big := attachVirtualDeviceWithMTU(t, serialApp, "COM16", []uint32{0x11}, 4096)
+	go serialApp.ListenMessagePerDevice("COM15", time.Now().UnixMilli())
+	go serialApp.ListenMessagePerDevice("COM16", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, small, "COM15", device.ChecksumCRC32C)
+	waitChecksum(t, serialApp, big, "COM16", device.ChecksumCRC32C)
+	if mtu, _ := serialApp.GetDeviceMTU("COM15"); mtu != 64 || small.MTU() != 64 {
+		t.Fatalf("MTU协商错误: 上位机%d 下位机%d 期望64", mtu, small.MTU())
+	}
+	if mtu, _ := serialApp.GetDeviceMTU("COM16"); mtu != 1024 || big.MTU() != 1024 {
+		t.Fatalf("MTU协商错误: 上位机%d 下位机%d 期望1024", mtu, big.MTU())
+	}
+	// 分片和重组使用各自的MTU
+	small.SetEcho(true)
+	big.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 400)
+	for _, moduleID := range []uint32{0x10, 0x11} {
+		channel := serialApp.GetSerialMessageChannel(moduleID)
+		serialApp.StartSendMessage(moduleID)
+		*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: moduleID, TargetFunction: "Echo", Data: data}
+		select {
+		case message := <-*channel.ReceiveDataChannel:
+			if !bytes.Equal(message.Data, data) {
+				t.Fatalf("模块%d回显的讯息不一致", moduleID)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("模块%d没有收到下位机的回显", moduleID)
+		}
+	}
+}
+
+func TestMTULimitLegacy(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetMTULimit(64)
+	serialApp.StartAutoInit()
+	pipe := device.NewPipe("COM37")
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	virtualDevice.SetLegacy()
+	virtualDevice.SetEcho(true)
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM37", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = serialApp.Close() })
+	go serialApp.ListenMessagePerDevice("COM37", time.Now().UnixMilli())
+	if _, err := waitProfile(t, serialApp, "COM37"); err != nil {
+		t.Fatal(err)
+	}
+	// 旧固件不知道上位机的上限 数据帧长度必须保持不变
+	if mtu, _ := serialApp.GetDeviceMTU("COM37"); mtu != _const.PortLen {
+		t.Fatalf("旧固件的数据帧长度被修改: %d", mtu)
+	}
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 200)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Echo", Data: data}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, data) {
+			t.Fatal("旧固件回显的讯息不一致")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("没有收到旧固件的回显")
+	}
+}
+
+// 连接一个声明了MTU的虚拟下位机
+func attachVirtualDeviceWithMTU(t *testing.T, serialApp *device.SerialApp, COM string, modules []uint32, mtu uint32) *device.VirtualDevice {
+	pipe := device.NewPipe(COM)
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), modules)
+	virtualDevice.SetMTU(mtu)
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	if err := serialApp.AutoInitPerDeviceWithTransport(COM, pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	return virtualDevice
+}
+
+// 等待和某个下位机的协商完成或者被拒绝
+func waitProfile(t *testing.T, serialApp *device.SerialApp, COM string) (device.Profile, error) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		profile, err := serialApp.GetDeviceProfile(COM)
+		var customErr *util.CustomError
+		if err == nil || !errors.As(err, &customErr) || customErr.ErrorMessage != "NotNegotiated" {
+			return profile, err
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("协商没有完成")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.StartAutoInit()
+	attach := func(COM string, setup func(*device.VirtualDevice)) {
+		pipe := device.NewPipe(COM)
+		virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+		setup(virtualDevice)
+		virtualDevice.Start()
+		t.Cleanup(virtualDevice.Stop)
+		if err := serialApp.AutoInitPerDeviceWithTransport(COM, pipe.Opener()); err != nil {
+			t.Fatal(err)
+		}
+		go serialApp.ListenMessagePerDevice(COM, time.Now().UnixMilli())
+	}
+	attach("COM17", func(virtualDevice *device.VirtualDevice) {
+		virtualDevice.SetProtocolVersions(device.ProtocolVersionLegacy, device.ProtocolVersion)
+		virtualDevice.SetFirmwareVersion("fw-1.2.3")
+	})
+	profile, err := waitProfile(t, serialApp, "COM17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ProtocolVersion != device.ProtocolVersion || profile.FirmwareVersion != "fw-1.2.3" || profile.Checksum != device.ChecksumCRC32C {
+		t.Fatalf("协商结果错误: %+v", profile)
+	}
+	// 更新的固件只支持上位机不认识的协议版本
+	attach("COM18", func(virtualDevice *device.VirtualDevice) {
+		virtualDevice.SetProtocolVersions(device.ProtocolVersion + 1)
+	})
+	_, err = waitProfile(t, serialApp, "COM18")
+	var customErr *util.CustomError
+	if !errors.As(err, &customErr) || !strings.HasPrefix(customErr.ErrorMessage, "IncompatibleProtocolVersion") {
+		t.Fatalf("不兼容的下位机应当被拒绝: %v", err)
+	}
+	if modules, _ := serialApp.GetDeviceSubModules("COM18"); len(modules) != 0 {
+		t.Fatal("被拒绝的下位机不应当注册功能模块")
+	}
+	// 要求新协议时拒绝旧固件
+	serialApp.SetMinProtocolVersion(device.ProtocolVersion)
+	attach("COM19", (*device.VirtualDevice).SetLegacy)
+	if _, err = waitProfile(t, serialApp, "COM19"); err == nil {
+		t.Fatal("最低协议版本之下的旧固件应当被拒绝")
+	}
+}
+
+func TestCompactHeaderNegotiation(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	config := serialApp.DefaultLineConfig()
+	config.Framing = device.FramingCOBS
+	config.Header = device.HeaderCompact
+	serialApp.SetLineConfigForPort("COM20", config)
+	serialApp.SetLineConfigForPort("COM21", config)
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDeviceWithMTU(t, serialApp, "COM20", []uint32{0x10}, 64)
+	go serialApp.ListenMessagePerDevice("COM20", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, virtualDevice, "COM20", device.ChecksumCRC32C)
+	if profile, _ := serialApp.GetDeviceProfile("COM20"); profile.Header != device.HeaderCompact || virtualDevice.Header() != device.HeaderCompact {
+		t.Fatalf("帧头布局协商错误: 上位机%s 下位机%s", profile.Header, virtualDevice.Header())
+	}
+	// 短讯息不分片 长讯息分片 都应当能够往返
+	virtualDevice.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	for _, data := range [][]byte{{1, 2, 3}, bytes.Repeat([]byte{7, 0}, 200)} {
+		*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Echo", Data: data}
+		select {
+		case message := <-*channel.ReceiveDataChannel:
+			if !bytes.Equal(message.Data, data) {
+				t.Fatal("紧凑帧头回显的讯息不一致")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("紧凑帧头没有收到下位机的回显")
+		}
+	}
+	// 下位机不支持紧凑帧头时使用完整帧头
+	pipe := device.NewPipe("COM21")
+	fullOnly := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), nil)
+	fullOnly.SetHeaders(device.HeaderFull)
+	fullOnly.Start()
+	t.Cleanup(fullOnly.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM21", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM21", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, fullOnly, "COM21", device.ChecksumCRC32C)
+	if profile, _ := serialApp.GetDeviceProfile("COM21"); profile.Header != device.HeaderFull {
+		t.Fatalf("下位机不支持紧凑帧头时应当使用完整帧头: %s", profile.Header)
+	}
+}
+
+func TestMessageCompression(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetCompression(0x10, device.CompressionConfig{Algorithm: device.CompressionFlate, Threshold: 64})
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM22", []uint32{0x10})
+	virtualDevice.SetCompression(device.CompressionConfig{Algorithm: device.CompressionFlate, Threshold: 64})
+	go serialApp.ListenMessagePerDevice("COM22", time.Now().UnixMilli())
+	if profile, err := waitProfile(t, serialApp, "COM22"); err != nil || len(profile.Compressions) != 1 || profile.Compressions[0] != device.CompressionFlate {
+		t.Fatalf("压缩算法协商错误: %+v %v", profile, err)
+	}
+	waitChecksum(t, serialApp, virtualDevice, "COM22", device.ChecksumCRC32C)
+	virtualDevice.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	// 短于阈值的讯息不压缩 校准表这样的长讯息压缩后发送 回显也是压缩的
+	table := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 512)
+	for _, data := range [][]byte{{1, 2, 3}, table} {
+		*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Calibrate", Data: data}
+		select {
+		case message := <-virtualDevice.Received():
+			if !bytes.Equal(message.Data, data) {
+				t.Fatal("下位机解压后的讯息不一致")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("下位机没有收到讯息")
+		}
+		select {
+		case message := <-*channel.ReceiveDataChannel:
+			if !bytes.Equal(message.Data, data) {
+				t.Fatal("上位机解压后的讯息不一致")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("没有收到下位机的回显")
+		}
+	}
+	stats, _ := serialApp.GetLinkStats("COM22")
+	if stats.CompressedMessages != 1 || stats.CompressionSavedBytes < uint64(len(table))/2 {
+		t.Fatalf("压缩统计错误: %+v", stats)
+	}
+}
+
+func TestPreSharedKeyAuthentication(t *testing.T) {
+	key := []byte("calibration-bench-key")
+	// 接收缓存很快超时 重放的数据帧不会被当作重复的数据帧丢弃
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 100, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetPreSharedKey("COM23", key)
+	serialApp.SetPreSharedKey("COM24", key)
+	serialApp.StartAutoInit()
+	pipe := device.NewPipe("COM23")
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	virtualDevice.SetPreSharedKey(key)
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM23", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM23", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, virtualDevice, "COM23", device.ChecksumCRC32C)
+	virtualDevice.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Move", Data: []byte{1, 2}}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, []byte{1, 2}) {
+			t.Fatal("认证后回显的讯息不一致")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("认证后没有收到下位机的回显")
+	}
+	expectDropped := func(reason string, check func(device.LinkStats) bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			stats, _ := serialApp.GetLinkStats("COM23")
+			if check(stats) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s没有被计入统计: %+v", reason, stats)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		select {
+		case message := <-*channel.ReceiveDataChannel:
+			t.Fatalf("%s的讯息不应当被投递: %+v", reason, message)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	// 接收缓存超时之后重放刚才的回显
+	time.Sleep(200 * time.Millisecond)
+	if err := virtualDevice.ReplayLastMessage(); err != nil {
+		t.Fatal(err)
+	}
+	expectDropped("重放", func(stats device.LinkStats) bool { return stats.Replays == 1 })
+	// 不知道密钥的一方注入的讯息
+	virtualDevice.SetPreSharedKey([]byte("wrong-key"))
+	if err := virtualDevice.SendMessage(&device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Move", Data: []byte{9}}); err != nil {
+		t.Fatal(err)
+	}
+	expectDropped("伪造", func(stats device.LinkStats) bool { return stats.AuthFailures == 1 })
+	// 没有密钥的下位机不能完成握手
+	attachVirtualDevice(t, serialApp, "COM24", []uint32{0x11})
+	go serialApp.ListenMessagePerDevice("COM24", time.Now().UnixMilli())
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, _ := serialApp.GetLinkStats("COM24")
+		if stats.AuthFailures >= 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("没有认证的握手讯息应当被丢弃")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if modules, _ := serialApp.GetDeviceSubModules("COM24"); len(modules) != 0 {
+		t.Fatal("没有认证的下位机不应当注册功能模块")
+	}
+}
+
+// 记录下位机写入的数据的传输 用于在另一个会话中重放
+type recordingTransport struct {
+	device.Transport
+	mu      sync.Mutex
+	written []byte
+}
+
+func (transport *recordingTransport) Write(p []byte) (int, error) {
+	transport.mu.Lock()
+	transport.written = append(transport.written, p...)
+	transport.mu.Unlock()
+	return transport.Transport.Write(p)
+}
+
+func (transport *recordingTransport) take() []byte {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	written := transport.written
+	transport.written = nil
+	return written
+}
+
+func TestReplayAcrossSessions(t *testing.T) {
+	key := []byte("calibration-bench-key")
+	session := func(COM string, transport func(device.Transport) device.Transport) (*device.SerialApp, *device.VirtualDevice, *device.Pipe) {
+		serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+		t.Cleanup(func() { _ = serialApp.Close() })
+		serialApp.SetPreSharedKey(COM, key)
+		serialApp.StartAutoInit()
+		pipe := device.NewPipe(COM)
+		virtualDevice := device.InitVirtualDevice(transport(pipe.DeviceEnd(10*time.Millisecond)), []uint32{0x10})
+		virtualDevice.SetPreSharedKey(key)
+		virtualDevice.Start()
+		t.Cleanup(virtualDevice.Stop)
+		if err := serialApp.AutoInitPerDeviceWithTransport(COM, pipe.Opener()); err != nil {
+			t.Fatal(err)
+		}
+		go serialApp.ListenMessagePerDevice(COM, time.Now().UnixMilli())
+		waitChecksum(t, serialApp, virtualDevice, COM, device.ChecksumCRC32C)
+		return serialApp, virtualDevice, pipe
+	}
+	move := func(serialApp *device.SerialApp, virtualDevice *device.VirtualDevice) {
+		if err := virtualDevice.SendMessage(&device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Move", Data: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-*serialApp.GetSerialMessageChannel(0x10).ReceiveDataChannel:
+		case <-time.After(2 * time.Second):
+			t.Fatal("认证后没有收到下位机的讯息")
+		}
+	}
+	// 第一个会话中录下下位机在握手之后发出的讯息
+	recorder := &recordingTransport{}
+	serialApp, virtualDevice, _ := session("COM38", func(transport device.Transport) device.Transport {
+		recorder.Transport = transport
+		return recorder
+	})
+	recorder.take()
+	move(serialApp, virtualDevice)
+	move(serialApp, virtualDevice)
+	recorded := recorder.take()
+	// 第二个会话的序列号重新开始 录下的讯息的序列号比它收到的都大
+	serialApp, virtualDevice, pipe := session("COM39", func(transport device.Transport) device.Transport { return transport })
+	move(serialApp, virtualDevice)
+	if _, err := pipe.DeviceEnd(10 * time.Millisecond).Write(recorded); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, _ := serialApp.GetLinkStats("COM39")
+		if stats.AuthFailures > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("跨会话重放的讯息没有被计入统计: %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case message := <-*serialApp.GetSerialMessageChannel(0x10).ReceiveDataChannel:
+		t.Fatalf("跨会话重放的讯息不应当被投递: %+v", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestForwardErrorCorrection(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	config := serialApp.DefaultLineConfig()
+	config.FEC = device.FECReedSolomon16
+	serialApp.SetLineConfigForPort("COM25", config)
+	serialApp.SetLineConfigForPort("COM26", config)
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM25", []uint32{0x10})
+	go serialApp.ListenMessagePerDevice("COM25", time.Now().UnixMilli())
+	waitChecksum(t, serialApp, virtualDevice, "COM25", device.ChecksumCRC32C)
+	if profile, _ := serialApp.GetDeviceProfile("COM25"); profile.FEC != device.FECReedSolomon16 {
+		t.Fatalf("前向纠错方式协商错误: %s", profile.FEC)
+	}
+	// 无线串口的噪声 每帧前导码之后有3个字节出错
+	virtualDevice.SetNoise(func(frame []byte) {
+		for _, i := range []int{5, 60, 300} {
+			frame[i] ^= 0xff
+		}
+	})
+	virtualDevice.SetEcho(true)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x10)
+	serialApp.StartSendMessage(0x10)
+	data := bytes.Repeat([]byte{3, 1, 4, 1, 5, 9}, 150)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Map", Data: data}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, data) {
+			t.Fatal("纠错后回显的讯息不一致")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("纠错后没有收到下位机的回显")
+	}
+	stats, _ := serialApp.GetLinkStats("COM25")
+	if stats.CorrectedFrames < 2 || stats.CorrectedBytes != 3*stats.CorrectedFrames || stats.ResendRequests != 0 {
+		t.Fatalf("前向纠错统计错误: %+v", stats)
+	}
+	// 下位机不支持时不纠错
+	pipe := device.NewPipe("COM26")
+	plain := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), nil)
+	plain.SetFECs(device.FECNone)
+	plain.Start()
+	t.Cleanup(plain.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM26", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM26", time.Now().UnixMilli())
+	if profile, err := waitProfile(t, serialApp, "COM26"); err != nil || profile.FEC != device.FECNone {
+		t.Fatalf("下位机不支持前向纠错时应当不纠错: %+v %v", profile, err)
+	}
+}
+
+func TestMalformedFrameHeaders(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	pipe := device.NewPipe("COM27")
+	deviceEnd := pipe.DeviceEnd(10 * time.Millisecond)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM27", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	go serialApp.ListenMessagePerDevice("COM27", time.Now().UnixMilli())
+	codec := device.DefaultFrameCodec()
+	envelope, _ := device.EncodeSerialMessage(&device.SerialMessage{TargetModuleID: 0x20, TargetFunction: "Status", Data: []byte{1}})
+	stream := make([]byte, 0)
+	// 通过校验但是帧头超出范围的数据帧 以及同一个数据报中总帧数不一致的数据帧
+	for _, frame := range []*device.Frame{
+		{BufferID: 1, FrameID: 5, FrameNum: 2, Payload: envelope},
+		{BufferID: 2, FrameID: 0, FrameNum: 0, Payload: envelope},
+		{BufferID: 3, FrameID: 0, FrameNum: 0xFFFFFFFF, Payload: envelope},
+		{BufferID: 4, FrameID: 0, FrameNum: 2, Payload: envelope},
+		{BufferID: 4, FrameID: 2, FrameNum: 3, Payload: envelope},
+		{BufferID: 5, FrameID: 0, FrameNum: 1, Payload: envelope},
+	} {
+		data, err := codec.EncodeFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	if _, err := deviceEnd.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, []byte{1}) {
+			t.Fatalf("收到了错误的讯息: %v", message.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("畸形的数据帧之后没有收到完好的讯息")
+	}
+	stats, _ := serialApp.GetLinkStats("COM27")
+	if stats.MalformedFrames != 4 {
+		t.Fatalf("帧头超出范围的数据帧没有被统计: %+v", stats)
+	}
+}
+
+func TestFalsePreambleNoResend(t *testing.T) {
+	serialApp := device.InitSerialApp(9600, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	pipe := device.NewPipe("COM36")
+	deviceEnd := pipe.DeviceEnd(10 * time.Millisecond)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM36", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = serialApp.Close() })
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	go serialApp.ListenMessagePerDevice("COM36", time.Now().UnixMilli())
+	codec := device.DefaultFrameCodec()
+	encode := func(bufferID uint32, data []byte) []byte {
+		envelope, _ := device.EncodeSerialMessage(&device.SerialMessage{TargetModuleID: 0x20, TargetFunction: "Status", Data: data})
+		frame, err := codec.EncodeFrame(&device.Frame{BufferID: bufferID, FrameNum: 1, Payload: envelope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	// 数据中带有一个完整帧头的数据帧 校验码损坏
+	inner := encode(9, []byte{9})
+	broken := encode(1, inner[:32])
+	broken[len(broken)-1] ^= 0xff
+	stream := append(broken, encode(2, []byte{2})...)
+	if _, err := deviceEnd.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-*channel.ReceiveDataChannel:
+		if !bytes.Equal(message.Data, []byte{2}) {
+			t.Fatalf("收到了错误的讯息: %v", message.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("损坏的数据帧之后没有收到完好的讯息")
+	}
+	// 只有对齐位置上的数据帧要求重发 数据中误认的前导码不会
+	stats, _ := serialApp.GetLinkStats("COM36")
+	if stats.ResendRequests != 1 {
+		t.Fatalf("重发请求的次数不正确: %+v", stats)
+	}
+}
+
+func TestSelectiveRepeat(t *testing.T) {
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetAckTimeout(20 * time.Millisecond)
+	serialApp.StartAutoInit()
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM28", []uint32{0x10})
+	go serialApp.ListenMessagePerDevice("COM28", time.Now().UnixMilli())
+	if profile, err := waitProfile(t, serialApp, "COM28"); err != nil || !profile.ARQ {
+		t.Fatalf("逐帧确认协商错误: %+v %v", profile, err)
+	}
+	waitChecksum(t, serialApp, virtualDevice, "COM28", device.ChecksumCRC32C)
+	// 每个数据报的第二帧第一次发送时丢失 只有这一帧需要重发
+	lost := make(map[uint32]bool)
+	virtualDevice.SetFrameLoss(func(frame *device.Frame) bool {
+		if frame.FrameID != 1 || lost[frame.BufferID] {
+			return false
+		}
+		lost[frame.BufferID] = true
+		return true
+	})
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	serialApp.StartSendMessage(0x20)
+	data := bytes.Repeat([]byte{2, 7, 1, 8}, 400)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Move", Data: data}
+	select {
+	case message := <-virtualDevice.Received():
+		if !bytes.Equal(message.Data, data) {
+			t.Fatal("重发后重组的数据不一致")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("丢失的数据帧没有被重发")
+	}
+	select {
+	case failure := <-*channel.SendFailedChannel:
+		t.Fatalf("重发成功的讯息不应当报告失败: %+v", failure)
+	case <-time.After(200 * time.Millisecond):
+	}
+	stats, _ := serialApp.GetLinkStats("COM28")
+	if stats.RetransmittedFrames == 0 || stats.FailedMessages != 0 {
+		t.Fatalf("重发统计错误: %+v", stats)
+	}
+	// 下位机收不到任何数据帧时 重发次数达到上限后向发送方报告失败
+	virtualDevice.SetFrameLoss(func(frame *device.Frame) bool { return true })
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Stop", Data: []byte{1}}
+	select {
+	case failure := <-*channel.SendFailedChannel:
+		var customErr *util.CustomError
+		if failure.COM != "COM28" || failure.Message.TargetFunction != "Stop" || !errors.As(failure.Err, &customErr) || customErr.ErrorMessage != device.ErrResendTimesExceeded.Error() {
+			t.Fatalf("发送失败的报告错误: %+v", failure)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("重发次数达到上限后没有报告失败")
+	}
+	stats, _ = serialApp.GetLinkStats("COM28")
+	if stats.FailedMessages != 1 {
+		t.Fatalf("失败的讯息没有被统计: %+v", stats)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
 	serialApp.StartAutoInit()
+	pipe := device.NewPipe("COM29")
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	// 只能缓存4帧 每帧要处理5毫秒的慢速下位机
+	virtualDevice.SetReceiveWindow(4, 5*time.Millisecond)
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM29", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	go serialApp.ListenMessagePerDevice("COM29", time.Now().UnixMilli())
+	if profile, err := waitProfile(t, serialApp, "COM29"); err != nil || !profile.ARQ || profile.Window != 4 {
+		t.Fatalf("接收窗口协商错误: %+v %v", profile, err)
+	}
+	waitChecksum(t, serialApp, virtualDevice, "COM29", device.ChecksumCRC32C)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	serialApp.StartSendMessage(0x20)
+	// 两个各有十几帧的讯息同时发送 在途的数据帧不能超过下位机的缓冲区
+	data := [][]byte{bytes.Repeat([]byte{1, 4, 1, 4}, 1500), bytes.Repeat([]byte{2, 7, 1, 8}, 1500)}
+	for i := range data {
+		*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Map", Data: data[i]}
+	}
+	for range data {
+		select {
+		case message := <-virtualDevice.Received():
+			if !bytes.Equal(message.Data, data[0]) && !bytes.Equal(message.Data, data[1]) {
+				t.Fatal("流量控制下重组的数据不一致")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("流量控制下下位机没有收到讯息")
+		}
+	}
+	if overflows := virtualDevice.Overflows(); overflows != 0 {
+		t.Fatalf("下位机的缓冲区溢出了%d帧", overflows)
+	}
+	stats, _ := serialApp.GetLinkStats("COM29")
+	if stats.FailedMessages != 0 {
+		t.Fatalf("流量控制下不应当有失败的讯息: %+v", stats)
+	}
+}
+
+func TestRunWithUnopenedPort(t *testing.T) {
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	events, cancelEvents := serialApp.SubscribeEvents(16)
+	defer cancelEvents()
+	// 打开端口失败的下位机仍然留在注册表中
+	openErr := errors.New("PortBusy")
+	err := serialApp.AutoInitPerDeviceWithTransport("COM40", func(*serial.Config) (device.Transport, error) {
+		return nil, openErr
+	})
+	if !errors.Is(err, openErr) {
+		t.Fatalf("打开端口的错误没有返回: %v", err)
+	}
+	if errs := serialApp.StartAllListenMessage(); len(*errs) != 1 {
+		t.Fatalf("无法开始监听的错误没有返回: %v", *errs)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- serialApp.Run(ctx) }()
+	// 监听和发送都不会开始 而是发布事件
+	for i := 0; i < 2; i++ {
+		event := waitEvent(t, events, device.EventStartFailed)
+		if event.COM != "COM40" || event.Err.ErrorMessage != device.ErrPortNotOpen.Error() {
+			t.Fatalf("事件不正确: %+v", event)
+		}
+	}
+	cancel()
+	select {
+	case <-runErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ctx结束后Run没有返回")
+	}
+}
+
+func TestRunAndClose(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- serialApp.Run(ctx) }()
+	pipe := device.NewPipe("COM30")
+	virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	virtualDevice.Start()
+	// 等待Run启动 之后注册的下位机自动开始监听和发送
+	time.Sleep(20 * time.Millisecond)
+	if err := serialApp.AutoInitPerDeviceWithTransport("COM30", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	waitChecksum(t, serialApp, virtualDevice, "COM30", device.ChecksumCRC32C)
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Map", Data: []byte("run")}
+	select {
+	case message := <-virtualDevice.Received():
+		if string(message.Data) != "run" {
+			t.Fatal("下位机收到的数据不一致")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run启动后下位机没有收到讯息")
+	}
+	// 没有人取走的讯息不能卡住监听线程
+	for i := 0; i < 3; i++ {
+		if err := virtualDevice.SendMessage(&device.SerialMessage{TargetModuleID: 0x20, TargetFunction: "Reply", Data: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-runErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ctx结束后Run没有返回")
+	}
+	virtualDevice.Stop()
+	if err := serialApp.Close(); err != nil {
+		t.Fatal("重复关闭不应当出错", err)
+	}
+	// 关闭之后停止线程不能阻塞
+	serialApp.StopListenMessage("COM30")
+	serialApp.StopSendMessage(0x20)
+	serialApp.StopAutoResend()
+	serialApp.StopAllSendChannels()
+	select {
+	case <-*channel.ReceiveDataChannel:
+		t.Fatal("关闭后消息通道应当被清空")
+	default:
+	}
+	if err := serialApp.Run(context.Background()); err == nil {
+		t.Fatal("关闭后不能再次运行")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("关闭后仍有线程没有退出: %d > %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 等待某种类型的事件 跳过其它类型的事件
+func waitEvent(t *testing.T, events <-chan *device.Event, kind device.EventKind) *device.Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("等待%v时事件管道被关闭", kind)
+			}
+			if event.Kind == kind {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("没有收到%v事件", kind)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetAckTimeout(20 * time.Millisecond)
+	serialApp.StartAutoInit()
+	events, _ := serialApp.SubscribeEvents(16)
+	virtualDevice := attachVirtualDevice(t, serialApp, "COM31", []uint32{0x10})
 	serialApp.StartAllListenMessage()
-	ch := make(chan struct{})
-	virtualDevice := device.InitSerialApp(Baud, time.Second, 3, 1000, 1000)
-	virtualDevice.StartAllListenMessage()
-	initModule := virtualDevice.GetSerialMessageChannel(_const.InitModule)
-	virtualDevice.StartSendMessage(_const.InitModule)
-	var testData []byte
-	testData=append([]byte{5},testData...)
-	msg := device.SerialMessage{
-		TargetModuleID: _const.InitModule,
-		TargetFunction: "InitData",
-		Data:           testData,
-	}
-	*initModule.SendDataChannel <- &msg
-	<-ch
+	if profile, err := waitProfile(t, serialApp, "COM31"); err != nil || !profile.ARQ {
+		t.Fatalf("逐帧确认协商错误: %+v %v", profile, err)
+	}
+	serialApp.StartAllSendChannels()
+	channel := serialApp.GetSerialMessageChannel(0x20)
+	serialApp.StartSendMessage(0x20)
+	// 没有下位机拥有的模块
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x99, TargetFunction: "Move"}
+	event := waitEvent(t, events, device.EventSendFailed)
+	if event.ModuleID != 0x99 || event.COM != "" || event.Err == nil || event.Err.ErrorLevel != _const.CommonException {
+		t.Fatalf("发送失败的事件错误: %+v", event)
+	}
+	// 重发次数达到上限
+	virtualDevice.SetFrameLoss(func(frame *device.Frame) bool { return true })
+	*channel.SendDataChannel <- &device.SerialMessage{TargetModuleID: 0x10, TargetFunction: "Stop", Data: []byte{1}}
+	event = waitEvent(t, events, device.EventResendExceeded)
+	if event.COM != "COM31" || event.ModuleID != 0x10 || !event.HasFrame || event.Err.ErrorMessage != device.ErrResendTimesExceeded.Error() {
+		t.Fatalf("重发失败的事件错误: %+v", event)
+	}
+	// 端口被关闭后读取出错 监听结束
+	if err := serialApp.ClosePort("COM31"); err != nil {
+		t.Fatal(err)
+	}
+	event = waitEvent(t, events, device.EventListenStopped)
+	if event.COM != "COM31" || event.Err == nil {
+		t.Fatalf("监听结束的事件错误: %+v", event)
+	}
+	// 关闭后事件管道被关闭
+	if err := serialApp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+	closed, _ := serialApp.SubscribeEvents(1)
+	if _, ok := <-closed; ok {
+		t.Fatal("关闭后订阅的事件管道应当已经关闭")
+	}
+}
+
+func TestSend(t *testing.T) {
+	serialApp := device.InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = serialApp.Close() })
+	serialApp.SetAckTimeout(20 * time.Millisecond)
+	serialApp.StartAutoInit()
+	attach := func(COM string, isARQ bool) *device.VirtualDevice {
+		pipe := device.NewPipe(COM)
+		virtualDevice := device.InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+		virtualDevice.SetARQ(isARQ)
+		virtualDevice.Start()
+		t.Cleanup(virtualDevice.Stop)
+		if err := serialApp.AutoInitPerDeviceWithTransport(COM, pipe.Opener()); err != nil {
+			t.Fatal(err)
+		}
+		go serialApp.ListenMessagePerDevice(COM, time.Now().UnixMilli())
+		return virtualDevice
+	}
+	acked := attach("COM32", true)
+	attach("COM33", false)
+	if profile, err := waitProfile(t, serialApp, "COM32"); err != nil || !profile.ARQ {
+		t.Fatalf("逐帧确认协商错误: %+v %v", profile, err)
+	}
+	if profile, err := waitProfile(t, serialApp, "COM33"); err != nil || profile.ARQ {
+		t.Fatalf("不确认的下位机协商错误: %+v %v", profile, err)
+	}
+	waitChecksum(t, serialApp, acked, "COM32", device.ChecksumCRC32C)
+	serialApp.StartAllSendChannels()
+	t.Cleanup(serialApp.StopAllSendChannels)
+	send := func(timeout time.Duration) (map[string]device.DeliveryOutcome, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		report, err := serialApp.Send(ctx, 0x10, "Move", bytes.Repeat([]byte{3, 1, 4}, 100))
+		outcomes := make(map[string]device.DeliveryOutcome)
+		for _, outcome := range report.Outcomes {
+			outcomes[outcome.COM] = outcome
+		}
+		if len(outcomes) != 2 {
+			t.Fatalf("每个拥有模块的下位机都应当有结果: %+v", report)
+		}
+		return outcomes, err
+	}
+	// 逐帧确认的下位机确认了整个数据报 不确认的下位机只能写入端口
+	outcomes, err := send(2 * time.Second)
+	if err != nil || outcomes["COM32"].Status != device.DeliveryAcked || outcomes["COM33"].Status != device.DeliverySent {
+		t.Fatalf("同步发送的结果错误: %+v %v", outcomes, err)
+	}
+	select {
+	case message := <-acked.Received():
+		if message.TargetFunction != "Move" {
+			t.Fatalf("下位机收到的讯息错误: %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("下位机没有收到讯息")
+	}
+	// 重发次数达到上限
+	acked.SetFrameLoss(func(frame *device.Frame) bool { return true })
+	outcomes, err = send(2 * time.Second)
+	var customErr *util.CustomError
+	if !errors.As(err, &customErr) || customErr.ErrorMessage != device.ErrDeliveryFailed.Error() {
+		t.Fatalf("没有送达时应当返回ErrDeliveryFailed: %v", err)
+	}
+	if outcome := outcomes["COM32"]; outcome.Status != device.DeliveryFailed || !errors.As(outcome.Err, &customErr) || customErr.ErrorMessage != device.ErrResendTimesExceeded.Error() {
+		t.Fatalf("重发失败的结果错误: %+v", outcome)
+	}
+	// 确认超时比ctx长 ctx结束时还没有结果
+	serialApp.SetAckTimeout(time.Second)
+	outcomes, err = send(50 * time.Millisecond)
+	if err == nil || outcomes["COM32"].Status != device.DeliveryTimeout || !errors.Is(outcomes["COM32"].Err, context.DeadlineExceeded) || outcomes["COM33"].Status != device.DeliverySent {
+		t.Fatalf("超时的结果错误: %+v %v", outcomes, err)
+	}
+	// 没有下位机拥有的模块
+	if _, err := serialApp.Send(context.Background(), 0x99, "Move", nil); err == nil {
+		t.Fatal("没有下位机拥有模块时应当返回错误")
+	}
 }
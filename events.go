@@ -0,0 +1,170 @@
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 线程中发生的错误不能返回给调用者 它们被发布为事件 每个订阅者都会收到所有事件
+ 发布事件的多半是端口线程 所以发布不阻塞 订阅者的管道已满时丢弃该事件并计数
+ SerialApp关闭后所有订阅者的管道被关闭
+*/
+
+// EventKind 事件的类型
+type EventKind int
+
+const (
+	// EventSendFailed 讯息没有装入任何下位机的发送缓存 例如没有下位机拥有目标模块或者讯息过长 或者装入后无法编码为数据帧
+	EventSendFailed EventKind = iota
+	// EventWriteFailed 写入端口失败 发送数据帧时失败会让端口线程停止轮转发送
+	EventWriteFailed
+	// EventResendExceeded 数据帧的发送次数达到上限仍未被确认 整个数据报被放弃
+	EventResendExceeded
+	// EventFrameDropped 收到的数据帧无法解码 或者无法放入接收缓存 或者收齐后无法交给模块
+	EventFrameDropped
+	// EventFeedbackFailed 无法处理下位机发来的重发反馈
+	EventFeedbackFailed
+	// EventStartFailed 无法开始监听或者发送 一般是下位机已经被移除
+	EventStartFailed
+	// EventListenStopped 读取端口出错或者丢弃端口数据出错 监听已经结束
+	EventListenStopped
+)
+
+// String 事件类型的名称
+// 传入：无
+// 传出：名称
+func (kind EventKind) String() string {
+	switch kind {
+	case EventSendFailed:
+		return "SendFailed"
+	case EventWriteFailed:
+		return "WriteFailed"
+	case EventResendExceeded:
+		return "ResendExceeded"
+	case EventFrameDropped:
+		return "FrameDropped"
+	case EventFeedbackFailed:
+		return "FeedbackFailed"
+	case EventStartFailed:
+		return "StartFailed"
+	case EventListenStopped:
+		return "ListenStopped"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event 线程中发生的错误
+type Event struct {
+	// 类型
+	Kind EventKind
+	// 下位机COM 和单个下位机无关时为空
+	COM string
+	// 讯息的目标模块 不知道时为0
+	ModuleID uint32
+	// BufferID和FrameID是否有效
+	HasFrame bool
+	// 数据报编号
+	BufferID uint32
+	// 数据帧号
+	FrameID uint32
+	// 错误 带有错误等级
+	Err *util.CustomError
+	// 发生的时间 毫秒
+	Time int64
+}
+
+// 事件的订阅者
+type eventHub struct {
+	// 互斥锁
+	mu sync.Mutex
+	// 订阅者的管道
+	subscribers map[*chan *Event]struct{}
+	// 是否已经关闭
+	isClosed bool
+	// 因为订阅者的管道已满而丢弃的事件数量
+	dropped atomic.Uint64
+}
+
+// 初始化事件的订阅者
+// 传入：无
+// 传出：订阅者
+func initEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[*chan *Event]struct{}),
+	}
+}
+
+// SubscribeEvents 订阅线程中发生的错误 没有及时取走的事件在管道已满时被丢弃 SerialApp关闭后管道被关闭
+// 传入：管道长度
+// 传出：事件管道，取消订阅的方法（取消后管道被关闭 可以重复调用）
+func (app *SerialApp) SubscribeEvents(size int) (<-chan *Event, func()) {
+	hub := app.events
+	channel := make(chan *Event, size)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.isClosed {
+		close(channel)
+		return channel, func() {}
+	}
+	hub.subscribers[&channel] = struct{}{}
+	return channel, func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		if _, ok := hub.subscribers[&channel]; ok {
+			delete(hub.subscribers, &channel)
+			close(channel)
+		}
+	}
+}
+
+// DroppedEvents 因为订阅者没有及时取走而丢弃的事件数量
+// 传入：无
+// 传出：数量
+func (app *SerialApp) DroppedEvents() uint64 {
+	return app.events.dropped.Load()
+}
+
+// 发布一个事件 不阻塞
+// 错误已经是CustomError时保留其错误等级 否则按传入的等级分类
+// 传入：事件，错误等级，错误
+// 传出：无
+func (app *SerialApp) publish(event Event, level int, err error) {
+	if err == nil {
+		return
+	}
+	event.Err = util.ErrToStruct(err)
+	if event.Err == nil {
+		event.Err = util.NewError(level, _const.Device, err)
+	}
+	event.Time = time.Now().UnixMilli()
+	hub := app.events
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for channel := range hub.subscribers {
+		e := event
+		select {
+		case *channel <- &e:
+		default:
+			hub.dropped.Add(1)
+		}
+	}
+}
+
+// 关闭所有订阅者的管道 之后发布的事件被丢弃
+// 传入：无
+// 传出：无
+func (hub *eventHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.isClosed = true
+	for channel := range hub.subscribers {
+		close(*channel)
+		delete(hub.subscribers, channel)
+	}
+}
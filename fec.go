@@ -0,0 +1,359 @@
+package device
+
+import (
+	"errors"
+)
+
+/*
+ 前向纠错在分片和传输之间 对前导码之后的整个数据帧内容做Reed-Solomon编码
+ 内容被切分为若干块 每块最多255字节 其中最后FEC.ParityLen()字节是校验符号 最后一块可以更短
+ 编码是系统码 数据原样保留在每块的开头 解码时先纠正每块中的错误 再验证数据帧的校验码
+ 每块最多纠正ParityLen()/2个字节的错误 纠错失败的数据帧仍然走重发的路径
+*/
+
+// FEC 前向纠错方式 初始化时和每个下位机协商
+type FEC byte
+
+const (
+	// FECNone 不纠错
+	FECNone FEC = iota
+	// FECReedSolomon8 每块8字节校验符号 每块可以纠正4字节的错误
+	FECReedSolomon8
+	// FECReedSolomon16 每块16字节校验符号 每块可以纠正8字节的错误
+	FECReedSolomon16
+)
+
+// Reed-Solomon码块的最大长度
+const rsBlockLen = 255
+
+// String 前向纠错方式的名称
+// 传入：无
+// 传出：名称
+func (fec FEC) String() string {
+	switch fec {
+	case FECNone:
+		return "None"
+	case FECReedSolomon8:
+		return "RS8"
+	case FECReedSolomon16:
+		return "RS16"
+	default:
+		return "Unknown"
+	}
+}
+
+// 是否是认识的前向纠错方式
+// 传入：无
+// 传出：是否认识
+func (fec FEC) isKnown() bool {
+	return fec <= FECReedSolomon16
+}
+
+// ParityLen 每块的校验符号长度
+// 传入：无
+// 传出：长度
+func (fec FEC) ParityLen() int {
+	switch fec {
+	case FECReedSolomon8:
+		return 8
+	case FECReedSolomon16:
+		return 16
+	default:
+		return 0
+	}
+}
+
+// 编码后长度为codedLen时能够承载的数据长度
+// 传入：编码后的长度
+// 传出：数据长度 不足以承载任何数据时为0
+func (fec FEC) dataLen(codedLen int) int {
+	parityLen := fec.ParityLen()
+	if parityLen == 0 {
+		return codedLen
+	}
+	blocks := (codedLen + rsBlockLen - 1) / rsBlockLen
+	// 最后一块至少要有一个数据字节
+	if codedLen-(blocks-1)*rsBlockLen <= parityLen {
+		blocks--
+		codedLen = blocks * rsBlockLen
+	}
+	return codedLen - blocks*parityLen
+}
+
+// 长度为dataLen的数据编码后的长度 每块数据之后都有校验符号
+// 传入：数据长度
+// 传出：编码后的长度
+func (fec FEC) codedLen(dataLen int) int {
+	parityLen := fec.ParityLen()
+	if parityLen == 0 {
+		return dataLen
+	}
+	blockDataLen := rsBlockLen - parityLen
+	return dataLen + (dataLen+blockDataLen-1)/blockDataLen*parityLen
+}
+
+// 编码
+// 传入：数据
+// 传出：编码后的数据
+func (fec FEC) encode(data []byte) []byte {
+	parityLen := fec.ParityLen()
+	if parityLen == 0 {
+		return data
+	}
+	generator := rsGenerator(parityLen)
+	blockDataLen := rsBlockLen - parityLen
+	coded := make([]byte, 0, len(data)+(len(data)/blockDataLen+1)*parityLen)
+	for start := 0; start < len(data); start += blockDataLen {
+		end := start + blockDataLen
+		if end > len(data) {
+			end = len(data)
+		}
+		coded = append(coded, data[start:end]...)
+		coded = append(coded, rsParity(data[start:end], generator)...)
+	}
+	return coded
+}
+
+// 解码 纠正每块中的错误
+// 传入：编码后的数据
+// 传出：数据，纠正的字节数，错误
+func (fec FEC) decode(coded []byte) ([]byte, int, error) {
+	parityLen := fec.ParityLen()
+	if parityLen == 0 {
+		return coded, 0, nil
+	}
+	data := make([]byte, 0, len(coded))
+	corrected := 0
+	for start := 0; start < len(coded); start += rsBlockLen {
+		end := start + rsBlockLen
+		if end > len(coded) {
+			end = len(coded)
+		}
+		if end-start <= parityLen {
+			return nil, corrected, errors.New("FECBlockTooShort")
+		}
+		block := make([]byte, end-start)
+		copy(block, coded[start:end])
+		n, err := rsCorrect(block, parityLen)
+		if err != nil {
+			return nil, corrected, err
+		}
+		corrected += n
+		data = append(data, block[:len(block)-parityLen]...)
+	}
+	return data, corrected, nil
+}
+
+// GF(2^8)的指数表和对数表 本原多项式为x^8+x^4+x^3+x^2+1
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// GF(2^8)乘法
+// 传入：两个元素
+// 传出：积
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// GF(2^8)除法
+// 传入：被除数，除数（不能为0）
+// 传出：商
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// GF(2^8)的幂
+// 传入：指数
+// 传出：α^指数
+func gfPow(n int) byte {
+	n %= 255
+	if n < 0 {
+		n += 255
+	}
+	return gfExp[n]
+}
+
+// 多项式求值 系数从高次到低次排列
+// 传入：多项式，自变量
+// 传出：值
+func polyEval(poly []byte, x byte) byte {
+	y := poly[0]
+	for _, c := range poly[1:] {
+		y = gfMul(y, x) ^ c
+	}
+	return y
+}
+
+// 多项式乘法 系数从高次到低次排列
+// 传入：两个多项式
+// 传出：积
+func polyMul(p []byte, q []byte) []byte {
+	r := make([]byte, len(p)+len(q)-1)
+	for i, a := range p {
+		for j, b := range q {
+			r[i+j] ^= gfMul(a, b)
+		}
+	}
+	return r
+}
+
+// 生成多项式 (x-α^0)(x-α^1)...(x-α^(n-1))
+// 传入：校验符号长度
+// 传出：生成多项式
+func rsGenerator(parityLen int) []byte {
+	generator := []byte{1}
+	for i := 0; i < parityLen; i++ {
+		generator = polyMul(generator, []byte{1, gfPow(i)})
+	}
+	return generator
+}
+
+// 计算一块数据的校验符号 也就是数据乘以x^n除以生成多项式的余数
+// 传入：数据，生成多项式
+// 传出：校验符号
+func rsParity(data []byte, generator []byte) []byte {
+	parityLen := len(generator) - 1
+	remainder := make([]byte, len(data)+parityLen)
+	copy(remainder, data)
+	for i := range data {
+		coef := remainder[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(generator); j++ {
+			remainder[i+j] ^= gfMul(generator[j], coef)
+		}
+	}
+	return remainder[len(data):]
+}
+
+// 纠正一块编码后的数据 原地修改
+// 依次计算伴随式 用Berlekamp-Massey算法求错误定位多项式 用Chien搜索找出错误位置 用Forney算法求错误值
+// 传入：编码后的一块数据，校验符号长度
+// 传出：纠正的字节数，错误
+func rsCorrect(block []byte, parityLen int) (int, error) {
+	// 伴随式 synd[i]是码字在α^i处的值
+	synd := make([]byte, parityLen)
+	hasError := false
+	for i := range synd {
+		synd[i] = polyEval(block, gfPow(i))
+		if synd[i] != 0 {
+			hasError = true
+		}
+	}
+	if !hasError {
+		return 0, nil
+	}
+	// Berlekamp-Massey 系数从低次到高次排列
+	locator := []byte{1}
+	previous := []byte{1}
+	for i := 0; i < parityLen; i++ {
+		previous = append(previous, 0)
+		copy(previous[1:], previous[:len(previous)-1])
+		previous[0] = 0
+		delta := synd[i]
+		for j := 1; j < len(locator) && j <= i; j++ {
+			delta ^= gfMul(locator[j], synd[i-j])
+		}
+		if delta == 0 {
+			continue
+		}
+		if len(previous) > len(locator) {
+			next := make([]byte, len(previous))
+			for j := range previous {
+				next[j] = gfMul(previous[j], delta)
+			}
+			inverse := gfDiv(1, delta)
+			for j := range locator {
+				previous[j] = gfMul(locator[j], inverse)
+			}
+			previous = previous[:len(locator)]
+			for j := range locator {
+				next[j] ^= locator[j]
+			}
+			locator = next
+			continue
+		}
+		for j := range previous {
+			locator[j] ^= gfMul(delta, previous[j])
+		}
+	}
+	for len(locator) > 1 && locator[len(locator)-1] == 0 {
+		locator = locator[:len(locator)-1]
+	}
+	errorCount := len(locator) - 1
+	if errorCount*2 > parityLen {
+		return 0, errors.New("FECTooManyErrors")
+	}
+	// Chien搜索 位置p对应的定位元为α^(n-1-p)
+	n := len(block)
+	positions := make([]int, 0, errorCount)
+	for p := 0; p < n; p++ {
+		x := gfPow(-(n - 1 - p))
+		value := byte(0)
+		for j := len(locator) - 1; j >= 0; j-- {
+			value = gfMul(value, x) ^ locator[j]
+		}
+		if value == 0 {
+			positions = append(positions, p)
+		}
+	}
+	if len(positions) != errorCount {
+		return 0, errors.New("FECTooManyErrors")
+	}
+	// 错误评估多项式 Ω(x)=S(x)Λ(x) mod x^parityLen 系数从低次到高次排列
+	evaluator := make([]byte, parityLen)
+	for i := 0; i < parityLen; i++ {
+		for j := 0; j <= i && j < len(locator); j++ {
+			evaluator[i] ^= gfMul(locator[j], synd[i-j])
+		}
+	}
+	// Forney 因为伴随式从α^0开始 错误值为X*Ω(X^-1)/Λ'(X^-1)
+	for _, p := range positions {
+		x := gfPow(n - 1 - p)
+		xInverse := gfDiv(1, x)
+		numerator := byte(0)
+		for j := len(evaluator) - 1; j >= 0; j-- {
+			numerator = gfMul(numerator, xInverse) ^ evaluator[j]
+		}
+		// 特征为2时形式导数只保留奇次项
+		denominator := byte(0)
+		for j := 1; j < len(locator); j += 2 {
+			denominator ^= gfMul(locator[j], gfPow(-(n-1-p)*(j-1)))
+		}
+		if denominator == 0 {
+			return 0, errors.New("FECTooManyErrors")
+		}
+		block[p] ^= gfMul(x, gfDiv(numerator, denominator))
+	}
+	// 纠正后的码字伴随式应当全为0
+	for i := 0; i < parityLen; i++ {
+		if polyEval(block, gfPow(i)) != 0 {
+			return 0, errors.New("FECTooManyErrors")
+		}
+	}
+	return errorCount, nil
+}
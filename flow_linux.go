@@ -0,0 +1,50 @@
+//go:build linux
+
+package device
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// 设置串口的RTS/CTS硬件流控 termios属于终端设备本身 所以另外打开一次同一个路径设置即可
+// 传入：串口路径，是否启用
+// 传出：错误
+func setHardwareFlowControl(name string, isEnabled bool) error {
+	file, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return controlFile(file, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		if isEnabled {
+			termios.Cflag |= unix.CRTSCTS
+		} else {
+			termios.Cflag &^= unix.CRTSCTS
+		}
+		return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	})
+}
+
+// 在文件描述符上执行操作 不使用Fd()以免文件被切换为阻塞模式而使读取超时失效
+// 传入：文件，操作
+// 传出：错误
+func controlFile(file *os.File, control func(fd int) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var controlErr error
+	err = conn.Control(func(fd uintptr) {
+		controlErr = control(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return controlErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package device
+
+import (
+	"errors"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+// 设置串口的RTS/CTS硬件流控 目前只支持Linux
+// 传入：串口路径，是否启用
+// 传出：错误
+func setHardwareFlowControl(name string, isEnabled bool) error {
+	if !isEnabled {
+		return nil
+	}
+	return util.NewError(_const.CommonException, _const.Device, errors.New("FlowControlNotSupported"))
+}
@@ -0,0 +1,82 @@
+package device
+
+import (
+	"errors"
+)
+
+// Framing 数据帧在字节流中的分帧方式 初始化时和每个下位机协商
+type Framing byte
+
+const (
+	// FramingFixed 定长数据帧 补零到FrameCodec.FrameLen 以同步前导码对齐
+	FramingFixed Framing = iota
+	// FramingCOBS COBS字节填充 以0x00分隔数据帧 数据帧和其内容一样长
+	FramingCOBS
+)
+
+// 分帧符 COBS编码后的数据中不会出现
+const frameDelimiter byte = 0x00
+
+// String 分帧方式的名称
+// 传入：无
+// 传出：名称
+func (framing Framing) String() string {
+	switch framing {
+	case FramingFixed:
+		return "Fixed"
+	case FramingCOBS:
+		return "COBS"
+	default:
+		return "Unknown"
+	}
+}
+
+// 是否是认识的分帧方式
+// 传入：无
+// 传出：是否认识
+func (framing Framing) isKnown() bool {
+	return framing <= FramingCOBS
+}
+
+// COBS编码 编码后的数据中没有0x00 不包含分帧符
+// 传入：数据
+// 传出：编码后的数据
+func cobsEncode(data []byte) []byte {
+	encoded := make([]byte, 1, len(data)+len(data)/254+2)
+	// 当前分组长度所在的位置
+	codeIndex := 0
+	code := byte(1)
+	for _, b := range data {
+		if b != 0 {
+			encoded = append(encoded, b)
+			code++
+		}
+		if b == 0 || code == 0xFF {
+			encoded[codeIndex] = code
+			codeIndex = len(encoded)
+			encoded = append(encoded, 0)
+			code = 1
+		}
+	}
+	encoded[codeIndex] = code
+	return encoded
+}
+
+// COBS解码
+// 传入：编码后的数据 不包含分帧符
+// 传出：数据，错误
+func cobsDecode(encoded []byte) ([]byte, error) {
+	data := make([]byte, 0, len(encoded))
+	for i := 0; i < len(encoded); {
+		code := int(encoded[i])
+		if code == 0 || i+code > len(encoded) {
+			return nil, errors.New("BadCOBS")
+		}
+		data = append(data, encoded[i+1:i+code]...)
+		i += code
+		if code != 0xFF && i < len(encoded) {
+			data = append(data, 0)
+		}
+	}
+	return data, nil
+}
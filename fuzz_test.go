@@ -0,0 +1,242 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+)
+
+// 初始化一个接有虚拟传输的SerialApp 模块通道都被移除 以免投递讯息时阻塞
+func initFuzzApp(t testing.TB) (*SerialApp, *SerialDevice) {
+	app := InitSerialApp(9600, time.Millisecond, 3, 1000, 1000)
+	pipe := NewPipe("COM1")
+	if err := app.AutoInitPerDeviceWithTransport("COM1", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = app.Close() })
+	app.RemoveSerialChannel(_const.InitModule)
+	app.RemoveSerialChannel(_const.FeedbackModule)
+	device, _ := app.getDevice("COM1")
+	return app, device
+}
+
+// 编码一个数据帧头 用于构造种子
+func fuzzFrame(codec *FrameCodec, bufferID uint32, frameID uint32, frameNum uint32, payload []byte) []byte {
+	data, _ := codec.EncodeFrame(&Frame{BufferID: bufferID, FrameID: frameID, FrameNum: frameNum, Payload: payload})
+	return data
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, codec := range []*FrameCodec{
+		{FrameLen: 64},
+		{FrameLen: 64, Checksum: ChecksumCRC32C, Header: HeaderCompact},
+		{FrameLen: 64, Checksum: ChecksumCRC16CCITT, Framing: FramingCOBS, FEC: FECReedSolomon8},
+	} {
+		f.Add(byte(codec.Checksum), byte(codec.Framing), byte(codec.Header), byte(codec.FEC), fuzzFrame(codec, 1, 0, 1, []byte{1, 2, 3}))
+		f.Add(byte(codec.Checksum), byte(codec.Framing), byte(codec.Header), byte(codec.FEC), fuzzFrame(codec, 1, 7, 2, nil))
+	}
+	f.Fuzz(func(t *testing.T, checksum byte, framing byte, header byte, fec byte, data []byte) {
+		codec := &FrameCodec{
+			FrameLen: 64,
+			Checksum: Checksum(checksum % 3),
+			Framing:  Framing(framing % 2),
+			Header:   HeaderProfile(header % 2),
+			FEC:      FEC(fec % 3),
+		}
+		frame, err := codec.DecodeFrame(data)
+		if err != nil {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("解码错误应当是FrameError: %v", err)
+			}
+			return
+		}
+		if uint32(len(frame.Payload)) > codec.payloadLen(false) {
+			t.Fatalf("解码出的数据超过了一帧能承载的长度: %d", len(frame.Payload))
+		}
+		rev, err := InitRevDataBuffer(frame)
+		if err == nil && (rev.frameNum == 0 || rev.frameID >= rev.frameNum || rev.frameNum > maxFrameNum) {
+			t.Fatalf("超出范围的帧头没有被拒绝: %+v", frame)
+		}
+	})
+}
+
+func FuzzFECCodedLen(f *testing.F) {
+	f.Add(byte(FECReedSolomon8), uint16(0))
+	f.Add(byte(FECReedSolomon16), uint16(rsBlockLen))
+	f.Add(byte(FECReedSolomon8), uint16(500))
+	f.Fuzz(func(t *testing.T, fec byte, dataLen uint16) {
+		fec_ := FEC(fec % 3)
+		if coded := len(fec_.encode(make([]byte, dataLen))); fec_.codedLen(int(dataLen)) != coded {
+			t.Fatalf("%v编码%d字节后的长度应当是%d: %d", fec_, dataLen, coded, fec_.codedLen(int(dataLen)))
+		}
+	})
+}
+
+func FuzzFrameReceiver(f *testing.F) {
+	codec := &FrameCodec{FrameLen: 64, Checksum: ChecksumCRC16CCITT}
+	valid := fuzzFrame(codec, 1, 0, 1, []byte{1, 2, 3})
+	f.Add(false, append([]byte{0xA5, 0x5A, 0xA5}, valid...))
+	f.Add(true, append(cobsEncode([]byte{FrameVersion, 0, 0}), 0, 0, 0xff))
+	f.Fuzz(func(t *testing.T, isCOBS bool, data []byte) {
+		codec := &FrameCodec{FrameLen: 64, Checksum: ChecksumCRC16CCITT}
+		if isCOBS {
+			codec.Framing = FramingCOBS
+		}
+		receiver := initFrameReceiver(codec, new(linkStats))
+		// 分两次放入 模拟一次读取不完整的数据帧
+		receiver.push(data[:len(data)/2])
+		receiver.push(data[len(data)/2:])
+		for i := 0; ; i++ {
+			if i > len(data)+1 {
+				t.Fatal("接收器没有消耗数据")
+			}
+			_, ok, _ := receiver.next()
+			if !ok {
+				break
+			}
+		}
+	})
+}
+
+func FuzzSubmitDataFrame(f *testing.F) {
+	envelope, _ := EncodeSerialMessage(&SerialMessage{TargetModuleID: 0x10, TargetFunction: "Echo", Data: []byte{1}})
+	f.Add(uint32(1), uint32(0), uint32(1), envelope, false)
+	f.Add(uint32(2), uint32(3), uint32(2), envelope, false)
+	f.Add(uint32(3), uint32(0), uint32(0), []byte{}, false)
+	f.Add(uint32(4), uint32(0), uint32(1), sealEnvelope([]byte("key"), nil, authToHost, 1, envelope), true)
+	f.Fuzz(func(t *testing.T, bufferID uint32, frameID uint32, frameNum uint32, payload []byte, isAuthenticated bool) {
+		app, device := initFuzzApp(t)
+		if isAuthenticated {
+			_ = device.actor.call(func() error {
+				device.authKey = []byte("key")
+				return nil
+			})
+		}
+		channel := app.GetSerialMessageChannel(0x10)
+		// 同一个数据报编号先后收到总帧数不同的数据帧
+		for _, num := range []uint32{frameNum, frameNum + 1} {
+			rev, err := InitRevDataBuffer(&Frame{BufferID: bufferID % 4, FrameID: frameID, FrameNum: num, Payload: payload})
+			if err != nil {
+				if !errors.Is(err, ErrFrameHeader) {
+					t.Fatalf("帧头超出范围应当返回ErrFrameHeader: %v", err)
+				}
+				continue
+			}
+			_ = device.actor.call(func() error { return device.revBuffer.submitDataFrame(rev) })
+			select {
+			case <-*channel.ReceiveDataChannel:
+			default:
+			}
+		}
+	})
+}
+
+func FuzzHandleFeedback(f *testing.F) {
+	f.Add(true, []byte{0, 0, 0, 1, 0, 0, 0, 0, 1, 9})
+	f.Add(false, []byte{0, 0, 0, 1, 0, 0, 0, 5, 1})
+	f.Add(false, []byte{0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, isResendData bool, data []byte) {
+		app, device := initFuzzApp(t)
+		feedback := make(chan *SerialMessage, 1)
+		app.frameFeedbackChannel.SendDataChannel = &feedback
+		// 正在接收的数据报1 和已经发送的数据报1
+		var deviceID byte
+		_ = device.actor.call(func() error {
+			_, _, _ = device.revBuffer.putDataFrame(&RevDataBuffer{bufferID: 1, frameID: 1, frameNum: 2, data: &[]byte{2}})
+			sent := bytes.Repeat([]byte{7}, 100)
+			device.sendBuffer.sendBuffer[1] = initSendDataBuffer(&sent, 1, 30)
+			deviceID = device.deviceID
+			return nil
+		})
+		function := _const.WrongOddVariation
+		if isResendData {
+			function = _const.ReSendData
+		}
+		if len(data) > 8 {
+			data[8] = deviceID
+		}
+		_ = app.handleFeedback(&SerialMessage{TargetModuleID: _const.FeedbackModule, TargetFunction: function, Data: data})
+		select {
+		case <-feedback:
+		default:
+		}
+	})
+}
+
+func FuzzAutoInit(f *testing.F) {
+	f.Add(true, encodeCapability(1, &deviceCapability{versions: []byte{ProtocolVersion}, checksums: []Checksum{ChecksumCRC32C}, mtu: 64}))
+	f.Add(false, []byte{1, 0, 0, 0, 0x10, 0, 0})
+	f.Add(true, []byte{1, capabilityMTU, 4, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, isCapability bool, data []byte) {
+		app, _ := initFuzzApp(t)
+		deviceID, _ := app.GetDeviceID("COM1")
+		if len(data) > 0 {
+			data[0] = deviceID
+		}
+		if isCapability {
+			_ = app.handleInitCapability(data)
+			data = []byte{deviceID}
+		}
+		_, err := app.handleInitData(data)
+		codec, _ := app.getDeviceCodec("COM1")
+		if err == nil && codec.FrameLen < minFrameLen {
+			t.Fatalf("协商出了过短的数据帧: %d", codec.FrameLen)
+		}
+	})
+}
+
+func FuzzParseEnvelope(f *testing.F) {
+	envelope, _ := EncodeSerialMessage(&SerialMessage{TargetModuleID: 1, TargetFunction: "Echo", Data: []byte{1, 2}})
+	compressed, _, _ := encodeSerialMessage(&SerialMessage{TargetModuleID: 1, Data: bytes.Repeat([]byte{1}, 100)}, CompressionFlate)
+	f.Add(envelope)
+	f.Add(compressed)
+	f.Add(sealEnvelope([]byte("key"), nil, authToHost, 1, envelope))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseDataToSerialMessage(&data)
+		_, _ = openEnvelope([]byte("key"), nil, authToHost, new(replayWindow), data)
+	})
+}
+
+func FuzzParseCapability(f *testing.F) {
+	f.Add(encodeCapability(1, &deviceCapability{versions: []byte{ProtocolVersion}, checksums: []Checksum{ChecksumCRC32C}, mtu: 64}))
+	f.Add([]byte{1, capabilityChecksum, 2, byte(ChecksumCRC32C), 0xEE})
+	f.Add([]byte{1, capabilityFraming, 2, byte(FramingCOBS), 0xEE})
+	f.Add([]byte{1, capabilityHeader, 2, byte(HeaderCompact), 0xEE})
+	f.Add([]byte{1, capabilityCompression, 2, byte(CompressionFlate), 0xEE})
+	f.Add([]byte{1, capabilityFEC, 2, byte(FECReedSolomon8), 0xEE})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, capability, err := parseCapability(data)
+		if err != nil {
+			return
+		}
+		for _, checksum := range capability.checksums {
+			if !checksum.isKnown() {
+				t.Fatalf("保留了不认识的校验方式: %d", checksum)
+			}
+		}
+		for _, framing := range capability.framings {
+			if !framing.isKnown() {
+				t.Fatalf("保留了不认识的分帧方式: %d", framing)
+			}
+		}
+		for _, header := range capability.headers {
+			if !header.isKnown() {
+				t.Fatalf("保留了不认识的帧头布局: %d", header)
+			}
+		}
+		for _, compression := range capability.compressions {
+			if !compression.isKnown() {
+				t.Fatalf("保留了不认识的压缩算法: %d", compression)
+			}
+		}
+		for _, fec := range capability.fecs {
+			if !fec.isKnown() {
+				t.Fatalf("保留了不认识的前向纠错方式: %d", fec)
+			}
+		}
+	})
+}
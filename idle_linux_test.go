@@ -0,0 +1,71 @@
+//go:build linux
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"golang.org/x/sys/unix"
+)
+
+// 进程已经消耗的CPU时间
+func cpuTime(t *testing.T) time.Duration {
+	var usage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &usage); err != nil {
+		t.Skip("无法获取CPU时间: " + err.Error())
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func TestIdleGoroutinesBlock(t *testing.T) {
+	app := InitSerialApp(115200, 10*time.Millisecond, 3, 1000, 1000)
+	t.Cleanup(func() { _ = app.Close() })
+	app.StartAutoInit()
+	pipe := NewPipe("COM1")
+	virtualDevice := InitVirtualDevice(pipe.DeviceEnd(10*time.Millisecond), []uint32{0x10})
+	virtualDevice.Start()
+	t.Cleanup(virtualDevice.Stop)
+	if err := app.AutoInitPerDeviceWithTransport("COM1", pipe.Opener()); err != nil {
+		t.Fatal(err)
+	}
+	app.StartAllListenMessage()
+	app.StartAllSendChannels()
+	t.Cleanup(app.StopAllSendChannels)
+	app.StartAutoResend()
+	app.StartSendMessage(_const.FeedbackModule)
+	app.GetSerialMessageChannel(0x20)
+	app.StartSendMessage(0x20)
+	time.Sleep(200 * time.Millisecond)
+	// 空闲时每个线程都阻塞在管道 定时器或者读取串口上 忙等的线程会占满一个核
+	start := cpuTime(t)
+	time.Sleep(500 * time.Millisecond)
+	if used := cpuTime(t) - start; used > 100*time.Millisecond {
+		t.Fatalf("空闲的500毫秒内消耗了%v的CPU时间", used)
+	}
+}
+
+func TestIdleZeroWindowBlocks(t *testing.T) {
+	app, device := initFuzzApp(t)
+	app.SetAckTimeout(20 * time.Millisecond)
+	// 下位机通告了0窗口 但是没有等待窗口的数据报 不需要探测
+	err := device.actor.call(func() error {
+		device.profile = &Profile{ARQ: true, Window: 4}
+		device.updateSendWindow(0, time.Now().UnixMilli())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.StartSendChannel("COM1"); err != nil {
+		t.Fatal(err)
+	}
+	// 等到探测时间过去
+	time.Sleep(100 * time.Millisecond)
+	start := cpuTime(t)
+	time.Sleep(500 * time.Millisecond)
+	if used := cpuTime(t) - start; used > 100*time.Millisecond {
+		t.Fatalf("窗口为0的空闲的500毫秒内消耗了%v的CPU时间", used)
+	}
+}
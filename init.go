@@ -1,14 +1,16 @@
 package device
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	_const "github.com/238Studio/child-nodes-assist/const"
-	"strconv"
+	"github.com/238Studio/child-nodes-assist/util"
 	"sync"
 	"time"
 
-	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
 )
-import serial_ "github.com/tarm/serial"
 
 // InitSerialApp 初始化SerialApp
 // 传入：COM口，波特率，超时时间
@@ -17,32 +19,31 @@ func InitSerialApp(baud int, readTimeout time.Duration, maxResendTimes int, RevB
 	app := new(SerialApp)
 	app.mu = new(sync.Mutex)
 	app.isAlive = false
+	app.ctx, app.cancel = context.WithCancel(context.Background())
 	app.SendBufferWaitTimeOut = SendBufferWaitTimeOut
 	app.RevBufferWaitTimeOut = RevBufferWaitTimeOut
 	app.serialDevicesByCOM = make(map[string]*SerialDevice)
 	app.serialDevicesBySubModuleID = make(map[uint32]*map[string]*SerialDevice)
 	app.serialChannelByNodeModulesID = make(map[uint32]*SerialChannel)
-	app.revBuffer = &RevBuffer{
-		revBuffer:              make(map[string]*map[uint32]*[]*[]byte),
-		revFuncStopChannels:    make(map[string]chan struct{}),
-		revBufferHangingPeriod: make(map[string]*map[uint32]int64),
-		revBufferResidue:       make(map[string]*map[uint32]uint32),
-		app:                    app,
-	}
+	app.portIDs = initPortIDAllocator()
+	app.events = initEventHub()
+	app.lineConfigByCOM = make(map[string]LineConfig)
+	app.lineConfigByUSB = make(map[usbID]LineConfig)
+	app.checksums = []Checksum{ChecksumCRC32C, ChecksumCRC16CCITT, ChecksumOddParity}
+	app.mtuLimit = _const.PortLen
+	app.minProtocolVersion = ProtocolVersionLegacy
+	app.compressions = []Compression{CompressionFlate}
+	app.compressionByModule = make(map[uint32]CompressionConfig)
+	app.preSharedKeys = make(map[string][]byte)
 	app.maxResendTimes = maxResendTimes
+	app.ackTimeout = defaultAckTimeout
 	app.Baud = baud
 	app.ReadTimeout = readTimeout
-	app.sendBuffer = &SendBuffer{
-		sendBuffer:           make(map[string]*map[uint32]*SendDataBuffer),
-		readySendBuffer:      make(map[string]*map[uint32]*SendDataBuffer),
-		sendBufferWaitTime:   make(map[string]*map[uint32]int64),
-		i:                    0,
-		j:                    0xFFF,
-		sendFuncStopChannels: make(map[string]*chan struct{}),
-		app:                  app,
-	}
 	app.frameFeedbackChannel = app.GetSerialMessageChannel(_const.FeedbackModule)
 	app.initDeviceChannel = app.GetSerialMessageChannel(_const.InitModule)
+	// 每个下位机初始化时会发来能力声明和初始化应答两条讯息 留出余量以免阻塞监听线程
+	initChannel := make(chan *SerialMessage, 16)
+	app.initDeviceChannel.ReceiveDataChannel = &initChannel
 	sc := make(chan struct{})
 	app.stopInitDeviceChannel = &sc
 	// todo 常量化
@@ -51,8 +52,9 @@ func InitSerialApp(baud int, readTimeout time.Duration, maxResendTimes int, RevB
 
 /*
 自动初始化的具体的含义是 在启动串口服务后
-初始化一个初始化模块 然后获取全部COM口 并向疑似下位机的初始化模块发送讯息 讯息内包括了下位机的COM口
-下位机会返回其具备的模块->功能 映射表 COM口
+初始化一个初始化模块 然后获取全部COM口 并向疑似下位机的初始化模块发送讯息 讯息内包括了上位机为该下位机分配的一字节编号
+编号和串口路径无关 COM3 /dev/ttyUSB0 /dev/serial/by-id/... 都通过分配器映射到编号
+下位机会返回其具备的模块->功能 映射表 以及该编号
 COM口长度 COM %模块&功能,功能,功能...%模块...
 此处为了方便处理 模块编号是字符串
 */
@@ -63,13 +65,16 @@ COM口长度 COM %模块&功能,功能,功能...%模块...
 func (app *SerialApp) AutoInitAllDevices() *[]error {
 	errs := make([]error, 0)
 	// 获取COM口并初始化，注册这些COM口
-	ports, err := serial.GetPortsList()
+	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
 		errs = append(errs, err)
 	}
-	for _, COM := range ports {
-		println("发现串口:" + COM)
-		err := app.AutoInitPerDevice(COM)
+	app.mu.Lock()
+	opener := app.transportOpener
+	app.mu.Unlock()
+	for _, port := range ports {
+		serialDevice := InitSerialDevice(port.Name, app.resolveLineConfig(port.Name, port), opener)
+		err := app.AutoInitDevice(serialDevice)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -77,20 +82,51 @@ func (app *SerialApp) AutoInitAllDevices() *[]error {
 	return &errs
 }
 
-// AutoInitPerDevice 自动初始化一个COM口
-// 传入：COM
-// 传出：无
-func (app *SerialApp) AutoInitPerDevice(COM string) error {
-	// 生成串口配置
+// InitSerialDevice 初始化一个未连接的下位机
+// 传入：COM，线路配置，打开传输的方法（为nil时打开真实串口）
+// 传出：下位机
+func InitSerialDevice(COM string, config LineConfig, opener TransportOpener) *SerialDevice {
 	serialDevice := new(SerialDevice)
 	serialDevice.COM = COM
 	serialDevice.isConnected = false
 	serialDevice.SubModuleID = make([]uint32, 0)
-	serialDevice.serialConfig = serial_.Config{
-		Name:        COM,
-		Baud:        app.Baud,
-		ReadTimeout: app.ReadTimeout,
+	serialDevice.setLineConfig(config)
+	serialDevice.opener = opener
+	serialDevice.codec = DefaultFrameCodec()
+	serialDevice.stats = new(linkStats)
+	serialDevice.sendWindow = unlimitedWindow
+	return serialDevice
+}
+
+// AutoInitPerDevice 自动初始化一个COM口
+// 传入：COM
+// 传出：无
+func (app *SerialApp) AutoInitPerDevice(COM string) error {
+	app.mu.Lock()
+	opener := app.transportOpener
+	app.mu.Unlock()
+	return app.AutoInitPerDeviceWithTransport(COM, opener)
+}
+
+// AutoInitPerDeviceWithTransport 通过指定的传输自动初始化一个下位机
+// 传入：COM，打开传输的方法（为nil时打开真实串口）
+// 传出：无
+func (app *SerialApp) AutoInitPerDeviceWithTransport(COM string, opener TransportOpener) error {
+	// 生成串口配置 按串口路径或USB厂商/产品ID覆盖默认配置
+	serialDevice := InitSerialDevice(COM, app.resolveLineConfig(COM, app.lookupPortDetails(COM)), opener)
+	return app.AutoInitDevice(serialDevice)
+}
+
+// AutoInitDevice 注册一个已经生成配置的下位机 打开其端口并发送握手
+// 传入：下位机
+// 传出：无
+func (app *SerialApp) AutoInitDevice(serialDevice *SerialDevice) error {
+	COM := serialDevice.COM
+	app.mu.Lock()
+	if serialDevice.authKey == nil {
+		serialDevice.authKey = app.preSharedKeys[COM]
 	}
+	app.mu.Unlock()
 	// 将设备加入设备列表
 	app.PutDeviceIntoSerialApp(serialDevice)
 	// 给设备发送其COM号
@@ -99,9 +135,34 @@ func (app *SerialApp) AutoInitPerDevice(COM string) error {
 	if err != nil {
 		return err
 	}
-	COM_, _ := strconv.ParseInt(COM[3:], 10, 8)
-	buffer := []byte{byte(COM_)}
-	_, err = serialDevice.portIO.Write(buffer)
+	// 握手编号只有一个字节 与串口路径无关 由分配器映射回真实路径
+	deviceID, err := app.portIDs.allocate(COM)
+	if err != nil {
+		return err
+	}
+	var handshake []byte
+	err = serialDevice.actor.call(func() (err error) {
+		handshake, err = serialDevice.startSession(deviceID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// 开启了波特率识别时 依次尝试候选波特率 直到收到有效的初始化应答
+	app.mu.Lock()
+	isDetectingBaud := len(app.baudCandidates) > 0
+	app.mu.Unlock()
+	if isDetectingBaud {
+		_, err = app.DetectBaud(COM)
+		if err != nil {
+			return err
+		}
+		app.startDeviceIfRunning(COM)
+		return nil
+	}
+	// 先开始监听 以免错过初始化应答
+	app.startDeviceIfRunning(COM)
+	_, err = app.getPortIO(serialDevice).Write(handshake)
 	if err != nil {
 		return err
 	}
@@ -112,46 +173,80 @@ func (app *SerialApp) AutoInitPerDevice(COM string) error {
 // 传入：无
 // 传出：无
 func (app *SerialApp) StartAutoInit() {
-	go func() {
+	app.goFunc(func() {
 		for {
 			select {
 			case <-*app.stopInitDeviceChannel:
-				break
+				return
+			case <-app.ctx.Done():
+				return
 			case msg := <-(*app.initDeviceChannel.ReceiveDataChannel):
-				println("收到:" + string(msg.Data))
-				if msg.TargetFunction == "InitData" {
-					i := 0
-					n := (len(msg.Data) - 1) / 4
-					modules := make([]uint32, 0)
-					COM := "COM" + string(msg.Data[0])
-					for i < n {
-						modules = append(modules, BytesToUint32(msg.Data[i*4+1:i*4+5]))
-						i++
-					}
-					app.RegisterSubModulesWithDevice(modules, COM)
+				switch msg.TargetFunction {
+				case InitCapability:
+					_ = app.handleInitCapability(msg.Data)
+				case _const.InitData:
+					_, _ = app.handleInitData(msg.Data)
 				}
-			default:
-				continue
 			}
 		}
-	}()
+	})
 }
 
-// InitRevDataBuffer 根据数据报初始化RevDataBuffer
-// 传入：一个数据报
-// 传出：*RevDataBuffer
-func InitRevDataBuffer(data *[]byte) *RevDataBuffer {
+// 处理下位机的初始化数据 格式为 握手编号[8位] 模块ID[32位]...
+// 传入：初始化数据
+// 传出：该下位机的COM，错误
+func (app *SerialApp) handleInitData(data []byte) (string, error) {
+	if len(data) < 1 {
+		return "", util.NewError(_const.TrivialException, _const.Device, errors.New("InitDataTooShort"))
+	}
+	COM, ok := app.portIDs.lookup(data[0])
+	if !ok {
+		return "", util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchDeviceID"))
+	}
+	modules := make([]uint32, 0)
+	for i := 1; i+4 <= len(data); i += 4 {
+		modules = append(modules, BytesToUint32(data[i:i+4]))
+	}
+	// 先协商链路参数 协商失败的下位机不注册其功能模块
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		err := app.negotiate(device)
+		if err != nil {
+			return err
+		}
+		device.SubModuleID = modules
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	app.RegisterSubModulesWithDevice(modules, COM)
+	return COM, nil
+}
+
+// InitRevDataBuffer 根据解码后的数据帧初始化RevDataBuffer 帧头中的字段来自下位机 超出范围时返回ErrFrameHeader
+// 传入：一个数据帧
+// 传出：*RevDataBuffer，错误
+func InitRevDataBuffer(frame *Frame) (*RevDataBuffer, error) {
+	if err := checkFrameHeader(frame); err != nil {
+		return nil, err
+	}
 	rev := new(RevDataBuffer)
-	frameID := BytesToUint32((*data)[0:4])
-	bufferID := BytesToUint32((*data)[4:8])
-	frameNum := BytesToUint32((*data)[8:12])
-	exactLength := BytesToUint32((*data)[12:16])
-	rev.frameID = frameID
-	rev.bufferID = bufferID
-	rev.frameNum = frameNum
-	var d []byte
-	//深拷贝
-	copy(d, (*data)[16:16+exactLength])
-	rev.data = &d
-	return rev
+	rev.frameID = frame.FrameID
+	rev.bufferID = frame.BufferID
+	rev.frameNum = frame.FrameNum
+	rev.data = &frame.Payload
+	return rev, nil
+}
+
+// 检查数据帧帧头中的字段是否超出范围
+// 传入：数据帧
+// 传出：错误
+func checkFrameHeader(frame *Frame) error {
+	if frame.FrameNum == 0 || frame.FrameNum > maxFrameNum {
+		return &FrameError{Kind: ErrFrameHeader, Frame: frame, Detail: fmt.Sprintf("frameNum %d", frame.FrameNum)}
+	}
+	if frame.FrameID >= frame.FrameNum {
+		return &FrameError{Kind: ErrFrameHeader, Frame: frame, Detail: fmt.Sprintf("frameID %d>=%d", frame.FrameID, frame.FrameNum)}
+	}
+	return nil
 }
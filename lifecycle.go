@@ -0,0 +1,181 @@
+package device
+
+import (
+	"context"
+	"errors"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ SerialApp的所有线程都在应用的生命周期内运行 生命周期由InitSerialApp创建 Close时结束
+ 每个线程都通过goFunc启动并计入等待组 除了各自的停止管道之外还会在生命周期结束时退出
+ 线程中可能阻塞的发送（例如投递给模块的通道）都同时等待生命周期结束 以免Close时卡住
+ Close依次结束生命周期 关闭所有端口以唤醒阻塞在读取上的线程 等待所有线程退出 最后清空所有消息通道
+*/
+
+// ErrAppClosed SerialApp已经关闭
+var ErrAppClosed = errors.New("SerialAppClosed")
+
+// Run 启动初始化 重传 所有已注册下位机的监听和发送线程 以及所有已注册消息通道的发送线程
+// 之后注册的下位机会自动启动监听和发送线程 阻塞直到ctx结束或者调用Close 然后关闭所有线程和端口
+// 传入：上下文
+// 传出：关闭端口时的错误
+func (app *SerialApp) Run(ctx context.Context) error {
+	app.mu.Lock()
+	if app.isAlive {
+		app.mu.Unlock()
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("AlreadyRunning"))
+	}
+	if app.ctx.Err() != nil {
+		app.mu.Unlock()
+		return util.NewError(_const.TrivialException, _const.Device, ErrAppClosed)
+	}
+	app.isAlive = true
+	COMs := make([]string, 0, len(app.serialDevicesByCOM))
+	for COM := range app.serialDevicesByCOM {
+		COMs = append(COMs, COM)
+	}
+	moduleIDs := make([]uint32, 0, len(app.serialChannelByNodeModulesID))
+	for moduleID := range app.serialChannelByNodeModulesID {
+		moduleIDs = append(moduleIDs, moduleID)
+	}
+	app.mu.Unlock()
+	app.StartAutoInit()
+	app.StartAutoResend()
+	for _, COM := range COMs {
+		app.startDevice(COM)
+	}
+	for _, moduleID := range moduleIDs {
+		// 初始化模块的讯息由初始化线程处理 不发往下位机
+		if moduleID != _const.InitModule {
+			app.StartSendMessage(moduleID)
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-app.ctx.Done():
+	}
+	return app.Close()
+}
+
+// Close 结束SerialApp的生命周期 停止所有线程 关闭所有端口并清空所有消息通道 所有线程退出后返回
+// 可以重复调用 关闭后的SerialApp不能再次运行
+// 传入：无
+// 传出：关闭端口时的错误
+func (app *SerialApp) Close() error {
+	app.closeOnce.Do(func() {
+		app.mu.Lock()
+		app.cancel()
+		app.isAlive = false
+		COMs := make([]string, 0, len(app.serialDevicesByCOM))
+		for COM := range app.serialDevicesByCOM {
+			COMs = append(COMs, COM)
+		}
+		app.mu.Unlock()
+		// 关闭端口 读取线程最迟在本次读取超时后退出 真实串口的读取总有超时 见OpenSerialTransport
+		for _, COM := range COMs {
+			err := app.ClosePort(COM)
+			if err != nil && app.closeErr == nil {
+				app.closeErr = err
+			}
+		}
+		app.wg.Wait()
+		app.drainChannels()
+		app.events.close()
+	})
+	return app.closeErr
+}
+
+// 在SerialApp的生命周期内启动一个线程 Close会等待其退出
+// 传入：线程
+// 传出：是否启动 已经关闭时不启动
+func (app *SerialApp) goFunc(f func()) bool {
+	if !app.track() {
+		return false
+	}
+	go func() {
+		defer app.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// 把当前线程计入等待组 退出时需要调用app.wg.Done
+// 传入：无
+// 传出：是否计入 已经关闭时不计入
+func (app *SerialApp) track() bool {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.ctx.Err() != nil {
+		return false
+	}
+	app.wg.Add(1)
+	return true
+}
+
+// 让一个下位机的端口线程开始监听和发送
+// 传入：COM
+// 传出：无
+func (app *SerialApp) startDevice(COM string) {
+	app.publish(Event{Kind: EventStartFailed, COM: COM}, _const.CommonException, app.startListening(COM, nil))
+	app.publish(Event{Kind: EventStartFailed, COM: COM}, _const.CommonException, app.StartSendChannel(COM))
+}
+
+// Run正在运行时让一个新注册的下位机开始监听和发送
+// 传入：COM
+// 传出：无
+func (app *SerialApp) startDeviceIfRunning(COM string) {
+	app.mu.Lock()
+	isAlive := app.isAlive
+	app.mu.Unlock()
+	if isAlive {
+		app.startDevice(COM)
+	}
+}
+
+// 清空所有消息通道中没有被取走的讯息
+// 传入：无
+// 传出：无
+func (app *SerialApp) drainChannels() {
+	app.mu.Lock()
+	channels := make([]*SerialChannel, 0, len(app.serialChannelByNodeModulesID)+2)
+	for _, channel := range app.serialChannelByNodeModulesID {
+		channels = append(channels, channel)
+	}
+	app.mu.Unlock()
+	channels = append(channels, app.frameFeedbackChannel, app.initDeviceChannel)
+	for _, channel := range channels {
+		drainChannel(*channel.ReceiveDataChannel)
+		drainChannel(*channel.SendDataChannel)
+		if channel.SendFailedChannel != nil {
+			drainChannel(*channel.SendFailedChannel)
+		}
+	}
+}
+
+// 取走一个通道中所有的元素
+// 传入：通道
+// 传出：无
+func drainChannel[T any](channel chan T) {
+	for {
+		select {
+		case <-channel:
+		default:
+			return
+		}
+	}
+}
+
+// 在生命周期内向模块的通道投递一条讯息 模块没有及时取走时阻塞 生命周期结束时放弃
+// 传入：通道，讯息
+// 传出：错误
+func (app *SerialApp) deliver(channel chan *SerialMessage, message *SerialMessage) error {
+	select {
+	case channel <- message:
+		return nil
+	case <-app.ctx.Done():
+		return util.NewError(_const.TrivialException, _const.Device, ErrAppClosed)
+	}
+}
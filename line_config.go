@@ -0,0 +1,211 @@
+package device
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+	"github.com/tarm/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// FlowControl 串口流控方式
+type FlowControl byte
+
+const (
+	// FlowControlNone 无流控
+	FlowControlNone FlowControl = iota
+	// FlowControlRTSCTS RTS/CTS硬件流控
+	FlowControlRTSCTS
+)
+
+// LineConfig 单个下位机的串口线路配置
+type LineConfig struct {
+	// 波特率
+	Baud int
+	// 数据位 为0时使用8位
+	DataBits byte
+	// 校验位 为0时无校验
+	Parity serial.Parity
+	// 停止位 为0时使用1位
+	StopBits serial.StopBits
+	// 流控方式
+	FlowControl FlowControl
+	// 希望使用的分帧方式 初始化时和下位机协商 下位机不支持时使用定长分帧
+	Framing Framing
+	// 希望使用的帧头布局 初始化时和下位机协商 下位机不支持时使用完整帧头
+	Header HeaderProfile
+	// 希望使用的前向纠错方式 初始化时和下位机协商 下位机不支持时不纠错
+	FEC FEC
+	// 串口消息等待时间
+	ReadTimeout time.Duration
+}
+
+// FlowControlTransport 支持设置流控的传输 线路配置要求流控时 传输必须实现该接口
+type FlowControlTransport interface {
+	// SetFlowControl 设置流控方式
+	SetFlowControl(flowControl FlowControl) error
+}
+
+// USB设备的厂商ID和产品ID
+type usbID struct {
+	// 厂商ID
+	VID string
+	// 产品ID
+	PID string
+}
+
+// 转换为tarm/serial的串口配置
+// 传入：串口路径
+// 传出：串口配置
+func (config LineConfig) serialConfig(name string) serial.Config {
+	return serial.Config{
+		Name:        name,
+		Baud:        config.Baud,
+		ReadTimeout: config.ReadTimeout,
+		Size:        config.DataBits,
+		Parity:      config.Parity,
+		StopBits:    config.StopBits,
+	}
+}
+
+// DefaultLineConfig 获取SerialApp的默认线路配置 也就是波特率和等待时间来自SerialApp的8N1无流控
+// 传入：无
+// 传出：线路配置
+func (app *SerialApp) DefaultLineConfig() LineConfig {
+	return LineConfig{
+		Baud:        app.Baud,
+		DataBits:    serial.DefaultSize,
+		Parity:      serial.ParityNone,
+		StopBits:    serial.Stop1,
+		FlowControl: FlowControlNone,
+		ReadTimeout: app.ReadTimeout,
+	}
+}
+
+// SetLineConfigForPort 为某个串口路径设置线路配置 该串口之后被自动初始化时使用 优先级最高
+// 传入：COM，线路配置
+// 传出：无
+func (app *SerialApp) SetLineConfigForPort(COM string, config LineConfig) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.lineConfigByCOM[COM] = config
+}
+
+// SetLineConfigForUSB 为某种USB串口设置线路配置 通过厂商ID和产品ID匹配 优先级低于串口路径
+// 传入：厂商ID，产品ID，线路配置
+// 传出：无
+func (app *SerialApp) SetLineConfigForUSB(VID string, PID string, config LineConfig) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.lineConfigByUSB[usbID{VID: strings.ToLower(VID), PID: strings.ToLower(PID)}] = config
+}
+
+// 获取某个串口应当使用的线路配置 优先级为 串口路径 USB厂商/产品ID 默认配置
+// 传入：COM，USB端口信息（可以为nil）
+// 传出：线路配置
+func (app *SerialApp) resolveLineConfig(COM string, details *enumerator.PortDetails) LineConfig {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	config, ok := app.lineConfigByCOM[COM]
+	if ok {
+		return config
+	}
+	if details != nil && details.IsUSB {
+		config, ok = app.lineConfigByUSB[usbID{VID: strings.ToLower(details.VID), PID: strings.ToLower(details.PID)}]
+		if ok {
+			return config
+		}
+	}
+	return app.DefaultLineConfig()
+}
+
+// 查找某个串口的USB信息 只有设置了USB线路配置时才会枚举串口
+// 传入：COM
+// 传出：USB端口信息 不存在时为nil
+func (app *SerialApp) lookupPortDetails(COM string) *enumerator.PortDetails {
+	app.mu.Lock()
+	hasUSBConfig := len(app.lineConfigByUSB) > 0
+	app.mu.Unlock()
+	if !hasUSBConfig {
+		return nil
+	}
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil
+	}
+	for _, port := range ports {
+		if port.Name == COM {
+			return port
+		}
+	}
+	return nil
+}
+
+// GetLineConfig 获取某个下位机当前的线路配置
+// 传入：下位机COM
+// 传出：线路配置，是否存在
+func (app *SerialApp) GetLineConfig(COM string) (LineConfig, bool) {
+	var config LineConfig
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		config = device.lineConfig
+		return nil
+	})
+	return config, err == nil
+}
+
+// SetLineConfig 在运行时修改某个下位机的线路配置 不需要重新注册下位机
+// 如果端口已经打开 则会用新的配置重新打开端口 正在进行的监听会切换到新的端口 不会结束
+// 端口在端口线程中先关闭再打开 因为有的系统不允许同时打开同一个串口两次
+// 传入：下位机COM，线路配置
+// 传出：错误
+func (app *SerialApp) SetLineConfig(COM string, config LineConfig) error {
+	return app.callDevice(COM, func(device *SerialDevice) error {
+		device.setLineConfig(config)
+		if !app.isConnected(device) {
+			return nil
+		}
+		// 关闭端口会唤醒读取线程 它的错误在重新开始监听时被丢弃
+		err := app.ClosePort(COM)
+		if err == nil {
+			err = app.openPort(device, device.serialConfig, device.lineConfig)
+		}
+		if err != nil {
+			device.actor.stopListening(err)
+			return err
+		}
+		device.actor.restartListening()
+		return nil
+	})
+}
+
+// 设置下位机的线路配置
+// 传入：线路配置
+// 传出：无
+func (device *SerialDevice) setLineConfig(config LineConfig) {
+	device.lineConfig = config
+	device.serialConfig = config.serialConfig(device.COM)
+}
+
+// 为刚打开的传输设置流控
+// 传入：传输，流控方式
+// 传出：错误
+func applyFlowControl(portIO Transport, flowControl FlowControl) error {
+	transport, ok := portIO.(FlowControlTransport)
+	if !ok {
+		if flowControl == FlowControlNone {
+			return nil
+		}
+		return util.NewError(_const.CommonException, _const.Device, errors.New("FlowControlNotSupported"))
+	}
+	return transport.SetFlowControl(flowControl)
+}
+
+// SetFlowControl 设置串口的流控方式
+// 传入：流控方式
+// 传出：错误
+func (transport *serialTransport) SetFlowControl(flowControl FlowControl) error {
+	return setHardwareFlowControl(transport.config.Name, flowControl == FlowControlRTSCTS)
+}
@@ -0,0 +1,479 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+/*
+ 下位机在初始化应答（InitData）之前通过InitCapability声明其能力 上位机为每一项选出双方都支持的选项 通过InitAccept告知下位机
+ 两者的数据格式相同 握手编号[8位] 然后是若干项 类型[8位] 长度[8位] 内容
+ InitCapability中每一项的内容是下位机支持的全部选项 InitAccept中每一项的内容是选定的选项
+ 协议版本取双方都支持的最高版本 没有共同版本或者没有共同校验方式的下位机会被拒绝 不注册其功能模块
+ 没有声明能力的旧固件的协议版本为1 只能使用奇校验和定长分帧 数据帧长度为_const.PortLen 上位机也不会向其发送InitAccept
+*/
+
+const (
+	// ProtocolVersion 上位机支持的最高协议版本
+	ProtocolVersion byte = 2
+	// ProtocolVersionLegacy 没有声明能力的旧固件的协议版本
+	ProtocolVersionLegacy byte = 1
+)
+
+const (
+	// InitCapability 下位机声明其能力的功能名
+	InitCapability = "InitCapability"
+	// InitAccept 上位机告知下位机协商结果的功能名
+	InitAccept = "InitAccept"
+)
+
+// 能力的类型
+const (
+	// 校验方式 每个选项1字节
+	capabilityChecksum byte = 1
+	// 分帧方式 每个选项1字节
+	capabilityFraming byte = 2
+	// 数据帧长度上限 也就是MTU 32位 协商结果取双方上限的较小值
+	capabilityMTU byte = 3
+	// 协议版本 每个选项1字节 没有声明时视为版本2
+	capabilityProtocolVersion byte = 4
+	// 压缩算法 每个选项1字节 协商结果是双方都支持的全部算法
+	capabilityCompression byte = 5
+	// 固件版本 字符串 只在InitCapability中出现
+	capabilityFirmwareVersion byte = 6
+	// 帧头布局 每个选项1字节
+	capabilityHeader byte = 7
+	// 前向纠错方式 每个选项1字节
+	capabilityFEC byte = 8
+	// 逐帧确认 没有内容 出现即表示支持 见arq.go
+	capabilityARQ byte = 9
+	// 接收缓冲区能容纳的数据帧数 16位 只在InitCapability中出现 见window.go
+	capabilityWindow byte = 10
+)
+
+// 数据帧长度的下限 至少要能容纳帧头 最长的校验码和一些数据
+const minFrameLen = 32
+
+// 启用前向纠错时一帧至少要能承载的数据长度
+const minFramePayloadLen = 8
+
+// Profile 和某个下位机协商出的链路参数
+type Profile struct {
+	// 协议版本
+	ProtocolVersion byte
+	// 校验方式
+	Checksum Checksum
+	// 分帧方式
+	Framing Framing
+	// 数据帧长度
+	MTU uint32
+	// 帧头布局
+	Header HeaderProfile
+	// 前向纠错方式
+	FEC FEC
+	// 是否逐帧确认并选择重传
+	ARQ bool
+	// 下位机接收缓冲区能容纳的数据帧数 为0时不做流量控制
+	Window uint16
+	// 双方都支持的压缩算法 不包含CompressionNone
+	Compressions []Compression
+	// 下位机的固件版本 旧固件为空
+	FirmwareVersion string
+}
+
+// 下位机的能力 或者是协商的结果
+type deviceCapability struct {
+	// 支持的协议版本
+	versions []byte
+	// 支持的校验方式
+	checksums []Checksum
+	// 支持的分帧方式
+	framings []Framing
+	// 支持的帧头布局
+	headers []HeaderProfile
+	// 支持的前向纠错方式
+	fecs []FEC
+	// 是否支持逐帧确认
+	arq bool
+	// 接收缓冲区能容纳的数据帧数 为0时说明没有声明
+	window uint16
+	// 数据帧长度上限 为0时说明没有声明
+	mtu uint32
+	// 支持的压缩算法
+	compressions []Compression
+	// 固件版本
+	firmwareVersion string
+}
+
+// 获取旧固件的能力
+// 传入：无
+// 传出：能力
+func legacyCapability() *deviceCapability {
+	return &deviceCapability{
+		versions:  []byte{ProtocolVersionLegacy},
+		checksums: []Checksum{ChecksumOddParity},
+		framings:  []Framing{FramingFixed},
+	}
+}
+
+// 编码能力
+// 传入：握手编号，能力
+// 传出：数据
+func encodeCapability(deviceID byte, capability *deviceCapability) []byte {
+	data := []byte{deviceID}
+	if len(capability.versions) > 0 {
+		data = append(data, capabilityProtocolVersion, byte(len(capability.versions)))
+		data = append(data, capability.versions...)
+	}
+	data = append(data, capabilityChecksum, byte(len(capability.checksums)))
+	for _, checksum := range capability.checksums {
+		data = append(data, byte(checksum))
+	}
+	data = append(data, capabilityFraming, byte(len(capability.framings)))
+	for _, framing := range capability.framings {
+		data = append(data, byte(framing))
+	}
+	if len(capability.headers) > 0 {
+		data = append(data, capabilityHeader, byte(len(capability.headers)))
+		for _, header := range capability.headers {
+			data = append(data, byte(header))
+		}
+	}
+	if len(capability.fecs) > 0 {
+		data = append(data, capabilityFEC, byte(len(capability.fecs)))
+		for _, fec := range capability.fecs {
+			data = append(data, byte(fec))
+		}
+	}
+	if capability.arq {
+		data = append(data, capabilityARQ, 0)
+	}
+	if capability.window != 0 {
+		data = append(data, capabilityWindow, 2)
+		data = append(data, uint16ToBytes(uint32(capability.window))...)
+	}
+	if capability.mtu != 0 {
+		data = append(data, capabilityMTU, 4)
+		data = append(data, Uint32ToBytes(capability.mtu)...)
+	}
+	if len(capability.compressions) > 0 {
+		data = append(data, capabilityCompression, byte(len(capability.compressions)))
+		for _, compression := range capability.compressions {
+			data = append(data, byte(compression))
+		}
+	}
+	if capability.firmwareVersion != "" {
+		data = append(data, capabilityFirmwareVersion, byte(len(capability.firmwareVersion)))
+		data = append(data, capability.firmwareVersion...)
+	}
+	return data
+}
+
+// 解析能力 不认识的类型会被跳过 不认识的选项会被丢弃 以免选用下位机声明的无效选项
+// 传入：数据
+// 传出：握手编号，能力，错误
+func parseCapability(data []byte) (byte, *deviceCapability, error) {
+	if len(data) < 1 {
+		return 0, nil, util.NewError(_const.TrivialException, _const.Device, errors.New("InitCapabilityTooShort"))
+	}
+	capability := new(deviceCapability)
+	for i := 1; i < len(data); {
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return 0, nil, util.NewError(_const.TrivialException, _const.Device, errors.New("InitCapabilityTruncated"))
+		}
+		value := data[i+2 : i+2+int(data[i+1])]
+		switch data[i] {
+		case capabilityProtocolVersion:
+			capability.versions = append(capability.versions, value...)
+		case capabilityChecksum:
+			for _, b := range value {
+				if Checksum(b).isKnown() {
+					capability.checksums = append(capability.checksums, Checksum(b))
+				}
+			}
+		case capabilityFraming:
+			for _, b := range value {
+				if Framing(b).isKnown() {
+					capability.framings = append(capability.framings, Framing(b))
+				}
+			}
+		case capabilityMTU:
+			if len(value) != 4 {
+				return 0, nil, util.NewError(_const.TrivialException, _const.Device, errors.New("BadCapabilityMTU"))
+			}
+			capability.mtu = BytesToUint32(value)
+		case capabilityCompression:
+			for _, b := range value {
+				if Compression(b).isKnown() {
+					capability.compressions = append(capability.compressions, Compression(b))
+				}
+			}
+		case capabilityFirmwareVersion:
+			capability.firmwareVersion = string(value)
+		case capabilityHeader:
+			for _, b := range value {
+				if HeaderProfile(b).isKnown() {
+					capability.headers = append(capability.headers, HeaderProfile(b))
+				}
+			}
+		case capabilityFEC:
+			for _, b := range value {
+				if FEC(b).isKnown() {
+					capability.fecs = append(capability.fecs, FEC(b))
+				}
+			}
+		case capabilityARQ:
+			capability.arq = true
+		case capabilityWindow:
+			if len(value) != 2 {
+				return 0, nil, util.NewError(_const.TrivialException, _const.Device, errors.New("BadCapabilityWindow"))
+			}
+			capability.window = uint16(bytesToUint16(value))
+		}
+		i += 2 + len(value)
+	}
+	if len(capability.versions) == 0 {
+		capability.versions = []byte{2}
+	}
+	return data[0], capability, nil
+}
+
+// 处理下位机声明的能力
+// 传入：能力数据
+// 传出：错误
+func (app *SerialApp) handleInitCapability(data []byte) error {
+	deviceID, capability, err := parseCapability(data)
+	if err != nil {
+		return err
+	}
+	COM, ok := app.portIDs.lookup(deviceID)
+	if !ok {
+		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchDeviceID"))
+	}
+	return app.callDevice(COM, func(device *SerialDevice) error {
+		device.capability = capability
+		return nil
+	})
+}
+
+// 和下位机协商链路参数 下位机声明过能力时会告知其结果 之后双方都使用选定的参数
+// 协商失败时会记录错误 可以通过GetDeviceProfile获取 在该下位机的端口线程中调用
+// 传入：下位机
+// 传出：错误
+func (app *SerialApp) negotiate(device *SerialDevice) error {
+	profile, err := app.chooseProfile(device)
+	device.profile = profile
+	device.negotiateErr = err
+	if err != nil {
+		return err
+	}
+	if profile.ProtocolVersion > ProtocolVersionLegacy {
+		err = app.sendControlMessage(device, &SerialMessage{
+			TargetModuleID: _const.InitModule,
+			TargetFunction: InitAccept,
+			Data: encodeCapability(device.deviceID, &deviceCapability{
+				versions:     []byte{profile.ProtocolVersion},
+				checksums:    []Checksum{profile.Checksum},
+				framings:     []Framing{profile.Framing},
+				headers:      []HeaderProfile{profile.Header},
+				fecs:         []FEC{profile.FEC},
+				arq:          profile.ARQ,
+				mtu:          profile.MTU,
+				compressions: profile.Compressions,
+			}),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	device.codec.Checksum = profile.Checksum
+	device.codec.Framing = profile.Framing
+	device.codec.FrameLen = profile.MTU
+	device.codec.Header = profile.Header
+	device.codec.FEC = profile.FEC
+	device.resetSendWindow(profile)
+	return nil
+}
+
+// 为下位机选出双方都支持的链路参数
+// 协议版本和校验方式取上位机优先级最高的共同选项
+// 分帧方式 帧头布局和前向纠错方式选用线路配置中的选项 下位机不支持时使用定长分帧和完整帧头
+// 数据帧长度取双方上限的较小值 下位机没有声明时使用_const.PortLen 旧固件不受上位机上限的限制 紧凑帧头时不超过maxCompactFrameLen
+// 传入：下位机
+// 传出：链路参数，错误
+func (app *SerialApp) chooseProfile(device *SerialDevice) (*Profile, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	capability := device.capability
+	if capability == nil {
+		capability = legacyCapability()
+	}
+	profile := &Profile{FirmwareVersion: capability.firmwareVersion}
+	for _, version := range capability.versions {
+		if version >= app.minProtocolVersion && version <= ProtocolVersion && version > profile.ProtocolVersion {
+			profile.ProtocolVersion = version
+		}
+	}
+	if profile.ProtocolVersion == 0 {
+		return nil, util.NewError(_const.CommonException, _const.Device,
+			fmt.Errorf("IncompatibleProtocolVersion: device %v, host %d-%d", capability.versions, app.minProtocolVersion, ProtocolVersion))
+	}
+	// 旧版本协议不协商其他参数
+	if profile.ProtocolVersion == ProtocolVersionLegacy {
+		capability = legacyCapability()
+	}
+	checksum, ok := chooseChecksum(app.checksums, capability.checksums)
+	if !ok {
+		return nil, util.NewError(_const.CommonException, _const.Device,
+			fmt.Errorf("NoCommonChecksum: device %v, host %v", capability.checksums, app.checksums))
+	}
+	profile.Checksum = checksum
+	profile.Framing = FramingFixed
+	for _, framing := range capability.framings {
+		if framing == device.lineConfig.Framing {
+			profile.Framing = framing
+		}
+	}
+	profile.Header = HeaderFull
+	for _, header := range capability.headers {
+		if header == device.lineConfig.Header {
+			profile.Header = header
+		}
+	}
+	profile.MTU = _const.PortLen
+	if capability.mtu != 0 {
+		profile.MTU = capability.mtu
+	}
+	// 旧固件无法得知协商的结果 总是使用_const.PortLen
+	if profile.ProtocolVersion > ProtocolVersionLegacy && profile.MTU > app.mtuLimit {
+		profile.MTU = app.mtuLimit
+	}
+	if profile.Header == HeaderCompact && profile.MTU > maxCompactFrameLen {
+		profile.MTU = maxCompactFrameLen
+	}
+	if profile.MTU < minFrameLen {
+		return nil, util.NewError(_const.CommonException, _const.Device,
+			fmt.Errorf("MTUTooSmall: %d<%d", profile.MTU, minFrameLen))
+	}
+	// 前向纠错选用线路配置中的方式 下位机不支持或者数据帧太短 纠错后放不下数据时不纠错
+	profile.FEC = FECNone
+	for _, fec := range capability.fecs {
+		codec := FrameCodec{FrameLen: profile.MTU, Checksum: profile.Checksum, Header: profile.Header, FEC: fec}
+		if fec == device.lineConfig.FEC && codec.PayloadLen() >= minFramePayloadLen {
+			profile.FEC = fec
+		}
+	}
+	// 声明支持逐帧确认的下位机总是使用选择重传 流量控制依赖确认中通告的接收窗口
+	profile.ARQ = capability.arq
+	if profile.ARQ {
+		profile.Window = capability.window
+	}
+	for _, compression := range app.compressions {
+		for _, c := range capability.compressions {
+			if c == compression && c != CompressionNone {
+				profile.Compressions = append(profile.Compressions, c)
+			}
+		}
+	}
+	return profile, nil
+}
+
+// 选择校验方式
+// 传入：上位机支持的校验方式（按优先级排列），下位机支持的校验方式
+// 传出：校验方式，是否存在共同的校验方式
+func chooseChecksum(preferred []Checksum, supported []Checksum) (Checksum, bool) {
+	for _, checksum := range preferred {
+		for _, s := range supported {
+			if s == checksum {
+				return checksum, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// SetMinProtocolVersion 设置上位机接受的最低协议版本 更低版本的下位机会被拒绝 默认为1 也就是接受旧固件
+// 传入：协议版本
+// 传出：无
+func (app *SerialApp) SetMinProtocolVersion(version byte) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.minProtocolVersion = version
+}
+
+// GetDeviceProfile 获取和某个下位机协商出的链路参数
+// 传入：下位机COM
+// 传出：链路参数，错误 下位机被拒绝时是拒绝的原因
+func (app *SerialApp) GetDeviceProfile(COM string) (Profile, error) {
+	var profile Profile
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		if device.negotiateErr != nil {
+			return device.negotiateErr
+		}
+		if device.profile == nil {
+			return util.NewError(_const.TrivialException, _const.Device, errors.New("NotNegotiated"))
+		}
+		profile = *device.profile
+		return nil
+	})
+	return profile, err
+}
+
+// SetChecksums 设置上位机支持的校验方式 按优先级从高到低排列 初始化时选用下位机也支持的第一个
+// 没有声明能力的旧固件视为只支持奇校验 所以不包含奇校验时将拒绝旧固件
+// 传入：校验方式
+// 传出：无
+func (app *SerialApp) SetChecksums(checksums ...Checksum) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.checksums = checksums
+}
+
+// GetDeviceChecksum 获取和某个下位机协商出的校验方式
+// 传入：下位机COM
+// 传出：校验方式，是否存在
+func (app *SerialApp) GetDeviceChecksum(COM string) (Checksum, bool) {
+	codec, ok := app.getDeviceCodec(COM)
+	return codec.Checksum, ok
+}
+
+// GetDeviceFraming 获取和某个下位机协商出的分帧方式
+// 传入：下位机COM
+// 传出：分帧方式，是否存在
+func (app *SerialApp) GetDeviceFraming(COM string) (Framing, bool) {
+	codec, ok := app.getDeviceCodec(COM)
+	return codec.Framing, ok
+}
+
+// SetMTULimit 设置上位机能够接受的数据帧长度上限 初始化时和下位机声明的上限取较小值 默认为_const.PortLen
+// 旧固件无法协商 仍然使用_const.PortLen
+// 传入：数据帧长度上限
+// 传出：无
+func (app *SerialApp) SetMTULimit(mtu uint32) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.mtuLimit = mtu
+}
+
+// GetDeviceMTU 获取和某个下位机协商出的数据帧长度
+// 传入：下位机COM
+// 传出：数据帧长度，是否存在
+func (app *SerialApp) GetDeviceMTU(COM string) (uint32, bool) {
+	codec, ok := app.getDeviceCodec(COM)
+	return codec.FrameLen, ok
+}
+
+// 获取某个下位机当前编解码器的副本
+// 传入：下位机COM
+// 传出：编解码器，是否存在
+func (app *SerialApp) getDeviceCodec(COM string) (FrameCodec, bool) {
+	var codec FrameCodec
+	err := app.callDevice(COM, func(device *SerialDevice) error {
+		codec = *device.codec
+		return nil
+	})
+	return codec, err == nil
+}
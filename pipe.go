@@ -0,0 +1,246 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Pipe 内存中的双向管道 一端交给SerialApp 另一端交给虚拟下位机 用于在没有硬件的情况下测试
+type Pipe struct {
+	// 管道名 也就是SerialApp一端看到的端点名
+	name string
+	// 上位机->下位机方向的缓存
+	toDevice *pipeBuffer
+	// 下位机->上位机方向的缓存
+	toHost *pipeBuffer
+	// 模拟的下位机波特率 为0时不模拟
+	deviceBaud int
+	// 上位机一端最近一次打开时的波特率
+	hostBaud int
+	// 互斥锁
+	mu sync.Mutex
+}
+
+// 单个方向的管道缓存
+type pipeBuffer struct {
+	// 互斥锁
+	mu sync.Mutex
+	// 尚未被读取的数据
+	data []byte
+	// 有新数据写入时的通知
+	notify chan struct{}
+}
+
+// 管道的一端
+type pipeTransport struct {
+	// 所属管道
+	pipe *Pipe
+	// 读取的缓存
+	in *pipeBuffer
+	// 写入的缓存
+	out *pipeBuffer
+	// 读取超时时间 为0时一直阻塞到有数据
+	readTimeout time.Duration
+	// 打开时的波特率
+	baud int
+	// 是否是上位机一端
+	isHost bool
+	// 是否已经关闭
+	isClosed bool
+	// 关闭通知
+	closed chan struct{}
+	// 互斥锁
+	mu sync.Mutex
+}
+
+// NewPipe 新建一个内存管道
+// 传入：管道名
+// 传出：管道
+func NewPipe(name string) *Pipe {
+	return &Pipe{
+		name:     name,
+		toDevice: &pipeBuffer{notify: make(chan struct{}, 1)},
+		toHost:   &pipeBuffer{notify: make(chan struct{}, 1)},
+	}
+}
+
+// HostEnd 获取上位机一端 每次调用都会得到一个新的句柄 关闭句柄不会影响管道本身
+// 传入：读取超时时间
+// 传出：传输
+func (pipe *Pipe) HostEnd(readTimeout time.Duration) Transport {
+	end := pipe.newEnd(pipe.toHost, pipe.toDevice, readTimeout, 0)
+	end.isHost = true
+	return end
+}
+
+// SetBaud 模拟下位机的波特率 上位机一端以不同的波特率打开时 双方写入的数据都会因为帧错误而丢失
+// 传入：波特率 为0时不模拟
+// 传出：无
+func (pipe *Pipe) SetBaud(baud int) {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+	pipe.deviceBaud = baud
+}
+
+// DeviceEnd 获取下位机一端
+// 传入：读取超时时间
+// 传出：传输
+func (pipe *Pipe) DeviceEnd(readTimeout time.Duration) Transport {
+	return pipe.newEnd(pipe.toDevice, pipe.toHost, readTimeout, 0)
+}
+
+// Opener 获取打开上位机一端的方法 可以直接交给SetTransportOpener或者InitSerialDevice
+// 传入：无
+// 传出：打开传输的方法
+func (pipe *Pipe) Opener() TransportOpener {
+	return func(config *serial.Config) (Transport, error) {
+		pipe.mu.Lock()
+		pipe.hostBaud = config.Baud
+		pipe.mu.Unlock()
+		end := pipe.newEnd(pipe.toHost, pipe.toDevice, config.ReadTimeout, config.Baud)
+		end.isHost = true
+		return end, nil
+	}
+}
+
+// 新建管道的一端
+// 传入：读取缓存，写入缓存，读取超时时间，波特率
+// 传出：传输
+func (pipe *Pipe) newEnd(in *pipeBuffer, out *pipeBuffer, readTimeout time.Duration, baud int) *pipeTransport {
+	return &pipeTransport{
+		pipe:        pipe,
+		in:          in,
+		out:         out,
+		readTimeout: readTimeout,
+		baud:        baud,
+		closed:      make(chan struct{}),
+	}
+}
+
+// Read 读取管道 超时后返回0字节
+// 传入：缓存
+// 传出：读取长度，错误
+func (transport *pipeTransport) Read(p []byte) (int, error) {
+	var timeout <-chan time.Time
+	if transport.readTimeout > 0 {
+		timer := time.NewTimer(transport.readTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		if transport.isClosedEnd() {
+			return 0, io.EOF
+		}
+		transport.in.mu.Lock()
+		if len(transport.in.data) > 0 {
+			n := copy(p, transport.in.data)
+			transport.in.data = transport.in.data[n:]
+			if len(transport.in.data) > 0 {
+				transport.in.wake()
+			}
+			transport.in.mu.Unlock()
+			return n, nil
+		}
+		transport.in.mu.Unlock()
+		select {
+		case <-transport.in.notify:
+		case <-transport.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, nil
+		}
+	}
+}
+
+// Write 写入管道
+// 传入：数据
+// 传出：写入长度，错误
+func (transport *pipeTransport) Write(p []byte) (int, error) {
+	if transport.isClosedEnd() {
+		return 0, io.ErrClosedPipe
+	}
+	if !transport.pipe.isBaudMatched(transport) {
+		return len(p), nil
+	}
+	transport.out.mu.Lock()
+	transport.out.data = append(transport.out.data, p...)
+	transport.out.wake()
+	transport.out.mu.Unlock()
+	return len(p), nil
+}
+
+// Flush 丢弃尚未读取的数据
+// 传入：无
+// 传出：错误
+func (transport *pipeTransport) Flush() error {
+	if transport.isClosedEnd() {
+		return io.ErrClosedPipe
+	}
+	transport.in.mu.Lock()
+	transport.in.data = nil
+	transport.in.mu.Unlock()
+	return nil
+}
+
+// Close 关闭这一端的句柄
+// 传入：无
+// 传出：错误
+func (transport *pipeTransport) Close() error {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if transport.isClosed {
+		return errors.New("PipeAlreadyClosed")
+	}
+	transport.isClosed = true
+	close(transport.closed)
+	return nil
+}
+
+// Info 获取管道元数据
+// 传入：无
+// 传出：元数据
+func (transport *pipeTransport) Info() TransportInfo {
+	return TransportInfo{
+		Kind: TransportPipe,
+		Name: transport.pipe.name,
+		Baud: transport.baud,
+	}
+}
+
+// 判断这一端写入的数据能否被对方正确接收
+// 传入：写入的一端
+// 传出：波特率是否一致
+func (pipe *Pipe) isBaudMatched(transport *pipeTransport) bool {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+	if pipe.deviceBaud == 0 {
+		return true
+	}
+	if transport.isHost {
+		return transport.baud == pipe.deviceBaud
+	}
+	return pipe.hostBaud == pipe.deviceBaud
+}
+
+// 判断这一端是否已经关闭
+// 传入：无
+// 传出：是否关闭
+func (transport *pipeTransport) isClosedEnd() bool {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	return transport.isClosed
+}
+
+// 通知等待中的读取方 调用时需要持有锁
+// 传入：无
+// 传出：无
+func (buffer *pipeBuffer) wake() {
+	select {
+	case buffer.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+// 握手编号分配器 为任意路径的串口（COM3 /dev/ttyUSB0 /dev/serial/by-id/...）分配一个字节的握手编号
+// 下位机只知道这个编号 上位机通过它映射回真实的串口路径 可以在多个线程中使用
+type portIDAllocator struct {
+	// 互斥锁
+	mu sync.Mutex
+	// COM->握手编号
+	idByCOM map[string]byte
+	// 握手编号->COM
+	COMByID map[byte]string
+}
+
+// 初始化握手编号分配器
+// 传入：无
+// 传出：分配器
+func initPortIDAllocator() *portIDAllocator {
+	return &portIDAllocator{
+		idByCOM: make(map[string]byte),
+		COMByID: make(map[byte]string),
+	}
+}
+
+// 为某个串口分配握手编号 已经分配过的直接返回原编号
+// 优先使用路径末尾的数字 例如COM5->5 /dev/ttyUSB1->1 被占用时使用最小的空闲编号
+// 传入：COM
+// 传出：握手编号，错误
+func (allocator *portIDAllocator) allocate(COM string) (byte, error) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	id, ok := allocator.idByCOM[COM]
+	if ok {
+		return id, nil
+	}
+	preferred, ok := preferredPortID(COM)
+	if ok {
+		if _, used := allocator.COMByID[preferred]; !used {
+			allocator.bind(COM, preferred)
+			return preferred, nil
+		}
+	}
+	for i := 0; i <= 0xFF; i++ {
+		if _, used := allocator.COMByID[byte(i)]; !used {
+			allocator.bind(COM, byte(i))
+			return byte(i), nil
+		}
+	}
+	return 0, util.NewError(_const.CommonException, _const.Device, errors.New("NoFreeDeviceID"))
+}
+
+// 释放某个串口的握手编号
+// 传入：COM
+// 传出：无
+func (allocator *portIDAllocator) release(COM string) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	id, ok := allocator.idByCOM[COM]
+	if !ok {
+		return
+	}
+	delete(allocator.idByCOM, COM)
+	delete(allocator.COMByID, id)
+}
+
+// 通过握手编号查找串口
+// 传入：握手编号
+// 传出：COM，是否存在
+func (allocator *portIDAllocator) lookup(id byte) (string, bool) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	COM, ok := allocator.COMByID[id]
+	return COM, ok
+}
+
+// 获取某个串口的握手编号
+// 传入：COM
+// 传出：握手编号，是否已经分配
+func (allocator *portIDAllocator) id(COM string) (byte, bool) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	id, ok := allocator.idByCOM[COM]
+	return id, ok
+}
+
+// 绑定串口和握手编号 需要持有allocator.mu
+// 传入：COM，握手编号
+// 传出：无
+func (allocator *portIDAllocator) bind(COM string, id byte) {
+	allocator.idByCOM[COM] = id
+	allocator.COMByID[id] = COM
+}
+
+// 从串口路径末尾的数字得到首选的握手编号
+// 传入：COM
+// 传出：握手编号，是否存在
+func preferredPortID(COM string) (byte, bool) {
+	i := len(COM)
+	for i > 0 && COM[i-1] >= '0' && COM[i-1] <= '9' {
+		i--
+	}
+	if i == len(COM) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(COM[i:], 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(n), true
+}
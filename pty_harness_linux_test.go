@@ -0,0 +1,150 @@
+//go:build linux
+
+package device
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 伪终端的传输类型
+const transportPTY = "pty"
+
+// PTY 一对Linux伪终端 slave一端的路径可以像真实串口一样被打开 master一端用于模拟下位机
+type PTY struct {
+	// master一端
+	master *os.File
+	// 保持打开的slave一端 避免SerialApp关闭串口时master读到挂断
+	slave *os.File
+	// slave一端的路径 例如/dev/pts/3
+	slavePath string
+}
+
+// OpenPTY 通过/dev/ptmx打开一对伪终端 并把slave一端设置为原始模式
+// 传入：无
+// 传出：伪终端，错误
+func OpenPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// 解锁slave一端并获取其编号
+	n := 0
+	err = controlFile(master, func(fd int) error {
+		err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+		if err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	slavePath := "/dev/pts/" + strconv.Itoa(n)
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	// 关闭回显和行缓冲 在串口被打开之前也不会改写数据
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err == nil {
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		err = unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios)
+	}
+	if err != nil {
+		_ = slave.Close()
+		_ = master.Close()
+		return nil, err
+	}
+	return &PTY{master: master, slave: slave, slavePath: slavePath}, nil
+}
+
+// SlavePath 获取slave一端的路径 可以作为串口配置的Name
+// 传入：无
+// 传出：路径
+func (pty *PTY) SlavePath() string {
+	return pty.slavePath
+}
+
+// Master 获取master一端的传输 交给虚拟下位机使用
+// 传入：读取超时时间
+// 传出：传输
+func (pty *PTY) Master(readTimeout time.Duration) Transport {
+	return &ptyTransport{pty: pty, readTimeout: readTimeout}
+}
+
+// Close 关闭伪终端的两端
+// 传入：无
+// 传出：错误
+func (pty *PTY) Close() error {
+	return errors.Join(pty.slave.Close(), pty.master.Close())
+}
+
+// 伪终端master一端的传输
+type ptyTransport struct {
+	// 所属的伪终端
+	pty *PTY
+	// 读取超时时间 为0时一直阻塞到有数据
+	readTimeout time.Duration
+}
+
+// Read 读取master一端 超时后返回0字节
+// 传入：缓存
+// 传出：读取长度，错误
+func (transport *ptyTransport) Read(p []byte) (int, error) {
+	if transport.readTimeout > 0 {
+		err := transport.pty.master.SetReadDeadline(time.Now().Add(transport.readTimeout))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := transport.pty.master.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+// Write 写入master一端
+// 传入：数据
+// 传出：写入长度，错误
+func (transport *ptyTransport) Write(p []byte) (int, error) {
+	return transport.pty.master.Write(p)
+}
+
+// Flush 丢弃伪终端中尚未收发的数据
+// 传入：无
+// 传出：错误
+func (transport *ptyTransport) Flush() error {
+	return controlFile(transport.pty.master, func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
+	})
+}
+
+// Close 关闭伪终端
+// 传入：无
+// 传出：错误
+func (transport *ptyTransport) Close() error {
+	return transport.pty.Close()
+}
+
+// Info 获取伪终端元数据
+// 传入：无
+// 传出：元数据
+func (transport *ptyTransport) Info() TransportInfo {
+	return TransportInfo{
+		Kind: transportPTY,
+		Name: transport.pty.slavePath,
+	}
+}
@@ -0,0 +1,173 @@
+//go:build linux
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
+)
+
+// 打开一对伪终端 把slave一端作为真实串口注册到SerialApp 在master一端运行虚拟下位机
+func initPTYDevice(t *testing.T, modules []uint32) (*SerialApp, *VirtualDevice, *PTY) {
+	pty, err := OpenPTY()
+	if err != nil {
+		t.Skip("无法打开伪终端: " + err.Error())
+	}
+	app := InitSerialApp(115200, 100*time.Millisecond, 3, 1000, 1000)
+	virtualDevice := InitVirtualDevice(pty.Master(10*time.Millisecond), modules)
+	virtualDevice.Start()
+	COM := pty.SlavePath()
+	t.Cleanup(func() {
+		_ = app.Close()
+		virtualDevice.Stop()
+	})
+	serialDevice := InitSerialDevice(COM, app.DefaultLineConfig(), nil)
+	err = app.AutoInitDevice(serialDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := app.GetTransportInfo(COM); info.Kind != TransportSerial {
+		t.Fatal("没有使用真实串口的代码路径")
+	}
+	return app, virtualDevice, pty
+}
+
+func TestPTYReadTimeout(t *testing.T) {
+	app, virtualDevice, pty := initPTYDevice(t, nil)
+	waitHandshake(t, virtualDevice)
+	// 下位机的握手应答会先到达 清空后再等待超时
+	device, _ := app.getDevice(pty.SlavePath())
+	portIO := app.getPortIO(device)
+	time.Sleep(50 * time.Millisecond)
+	if err := portIO.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	n, err := portIO.Read(make([]byte, 16))
+	if err != nil || n != 0 {
+		t.Fatalf("超时读取应当返回0字节且没有错误: %d %v", n, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("读取没有在ReadTimeout后返回")
+	}
+}
+
+func TestPTYFlush(t *testing.T) {
+	app, virtualDevice, pty := initPTYDevice(t, nil)
+	waitHandshake(t, virtualDevice)
+	err := virtualDevice.SendMessage(&SerialMessage{TargetModuleID: 0x10, TargetFunction: "Ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	device, _ := app.getDevice(pty.SlavePath())
+	portIO := app.getPortIO(device)
+	if err := portIO.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := portIO.Read(make([]byte, 16))
+	if err != nil || n != 0 {
+		t.Fatalf("Flush之后不应当还有数据: %d %v", n, err)
+	}
+}
+
+func TestPTYSendToVirtualDevice(t *testing.T) {
+	app, virtualDevice, pty := initPTYDevice(t, []uint32{0x10})
+	id := waitHandshake(t, virtualDevice)
+	if COM, _ := app.GetCOMByDeviceID(id); COM != pty.SlavePath() {
+		t.Fatalf("下位机编号%d没有映射回%s", id, pty.SlavePath())
+	}
+	app.RegisterSubModulesWithDevice([]uint32{0x10}, pty.SlavePath())
+	if errs := app.StartAllSendChannels(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	t.Cleanup(app.StopAllSendChannels)
+	data := bytes.Repeat([]byte{0x00, 0x0d, 0x0a, 0x11, 0x13}, 300)
+	err := app.send(nil, 0x10, "Table", &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-virtualDevice.Received():
+		if message.TargetModuleID != 0x10 || message.TargetFunction != "Table" || !bytes.Equal(message.Data, data) {
+			t.Fatal("经过伪终端后数据不一致")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("虚拟下位机没有收到数据")
+	}
+}
+
+func TestPTYLineConfig(t *testing.T) {
+	app, virtualDevice, pty := initPTYDevice(t, nil)
+	waitHandshake(t, virtualDevice)
+	config := app.DefaultLineConfig()
+	config.Baud = 921600
+	// Linux的伪终端总是强制8位无校验 所以这里不检查校验位
+	config.Parity = serial.ParityEven
+	config.FlowControl = FlowControlRTSCTS
+	// 运行时修改 不需要重新注册下位机
+	err := app.SetLineConfig(pty.SlavePath(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	termios, err := unix.IoctlGetTermios(int(pty.slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cflag&unix.CBAUD != unix.B921600 {
+		t.Fatal("波特率没有生效")
+	}
+	if termios.Cflag&unix.CRTSCTS == 0 {
+		t.Fatal("RTS/CTS流控没有生效")
+	}
+	if got, _ := app.GetLineConfig(pty.SlavePath()); got != config {
+		t.Fatal("线路配置没有被记录")
+	}
+}
+
+// 等待虚拟下位机收到握手
+func TestPTYCloseWithoutReadTimeout(t *testing.T) {
+	pty, err := OpenPTY()
+	if err != nil {
+		t.Skip("无法打开伪终端: " + err.Error())
+	}
+	t.Cleanup(func() { _ = pty.Close() })
+	// 读取等待时间为0 监听线程会一直阻塞在没有数据的串口上
+	app := InitSerialApp(115200, 0, 3, 1000, 1000)
+	app.PutDeviceIntoSerialApp(InitSerialDevice(pty.SlavePath(), app.DefaultLineConfig(), nil))
+	if err := app.OpenPort(pty.SlavePath()); err != nil {
+		t.Fatal(err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.Run(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- app.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close没有返回")
+	}
+	select {
+	case <-runErr:
+	case <-time.After(time.Second):
+		t.Fatal("Run没有返回")
+	}
+}
+
+func waitHandshake(t *testing.T, virtualDevice *VirtualDevice) byte {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if id, ok := virtualDevice.DeviceID(); ok {
+			return id
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("虚拟下位机没有收到握手")
+	return 0
+}
@@ -8,11 +8,82 @@ import (
 	"github.com/238Studio/child-nodes-assist/util"
 )
 
-// ParseDataToSerialMessage 将纯数据转为数据
+/*
+ 消息信封的格式是 目标模块编号[32位] 标志位[8位] 目标功能长度[8位] 目标功能 数据
+ 标志位的低4位是数据的压缩算法 0x10表示信封经过认证 见auth.go 其余位保留 必须为0 数据的长度就是信封剩余的长度
+*/
+
+// 消息信封中目标功能之前的长度
+const envelopeHeaderLen = 6
+
+// 消息信封标志位中表示压缩算法的位
+const envelopeCompressionMask byte = 0x0F
+
+// EncodeSerialMessage 将讯息编码为消息信封 编码后的纯数据会被分片发送
+// 传入：*SerialMessage
+// 传出：纯数据，错误
+func EncodeSerialMessage(message *SerialMessage) ([]byte, error) {
+	data, _, err := encodeSerialMessage(message, CompressionNone)
+	return data, err
+}
+
+// 将讯息编码为消息信封 并用指定的算法压缩数据 压缩后没有变短时不压缩
+// 传入：讯息，压缩算法
+// 传出：纯数据，是否压缩，错误
+func encodeSerialMessage(message *SerialMessage, compression Compression) ([]byte, bool, error) {
+	if len(message.TargetFunction) > 0xFF {
+		return nil, false, util.NewError(_const.TrivialException, _const.Device, errors.New("FunctionNameTooLong"))
+	}
+	payload := message.Data
+	if compression != CompressionNone {
+		compressed, err := compression.compress(message.Data)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(compressed) < len(message.Data) {
+			payload = compressed
+		} else {
+			compression = CompressionNone
+		}
+	}
+	data := make([]byte, 0, envelopeHeaderLen+len(message.TargetFunction)+len(payload))
+	data = append(data, Uint32ToBytes(message.TargetModuleID)...)
+	data = append(data, byte(compression), byte(len(message.TargetFunction)))
+	data = append(data, message.TargetFunction...)
+	data = append(data, payload...)
+	return data, compression != CompressionNone, nil
+}
+
+// ParseDataToSerialMessage 将纯数据转为数据 也就是解析消息信封
 // 传入：*byte[]
-// 传出：*SerialMessage
-func ParseDataToSerialMessage(data *[]byte) *SerialMessage {
-	return nil
+// 传出：*SerialMessage，错误
+func ParseDataToSerialMessage(data *[]byte) (*SerialMessage, error) {
+	if len(*data) < envelopeHeaderLen {
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("EnvelopeTooShort"))
+	}
+	if (*data)[4]&^envelopeCompressionMask != 0 {
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("UnknownEnvelopeFlags"))
+	}
+	compression := Compression((*data)[4] & envelopeCompressionMask)
+	functionEnd := envelopeHeaderLen + int((*data)[5])
+	if len(*data) < functionEnd {
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("FunctionNameTruncated"))
+	}
+	message := &SerialMessage{
+		TargetModuleID: BytesToUint32((*data)[:4]),
+		TargetFunction: string((*data)[envelopeHeaderLen:functionEnd]),
+	}
+	if compression != CompressionNone {
+		decompressed, err := compression.decompress((*data)[functionEnd:])
+		if err != nil {
+			return nil, err
+		}
+		message.Data = decompressed
+		return message, nil
+	}
+	message.Data = make([]byte, len(*data)-functionEnd)
+	copy(message.Data, (*data)[functionEnd:])
+	return message, nil
 }
 
 // VerifyOddParity 验证奇校验数
@@ -81,195 +152,319 @@ func BytesToUint32(bytes []byte) uint32 {
 }
 
 // 通过串口发送数据给单个下位机 根据对应的模块功能
+// 每个目标下位机的发送缓存都由其端口线程装入 一个下位机失败时仍然发送给其它下位机 每个失败都发布为事件
 // 传入：下位机的模块ID
-// 传出：无
+// 传出：第一个错误
 func (app *SerialApp) send(channel *SerialChannel, targetModuleID uint32, targetFunction string, data *[]byte) error {
+	targets, err := app.sendTargets(targetModuleID)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, device := range targets {
+		err := device.actor.call(func() error {
+			_, err := app.readyToSendToDevice(channel, targetModuleID, targetFunction, device, data)
+			return err
+		})
+		if err != nil {
+			app.publish(Event{Kind: EventSendFailed, COM: device.COM, ModuleID: targetModuleID}, _const.CommonException, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// 获取拥有某个模块的所有下位机 没有时发布事件并返回错误
+// 传入：模块ID
+// 传出：下位机，错误
+func (app *SerialApp) sendTargets(targetModuleID uint32) ([]*SerialDevice, error) {
 	app.mu.Lock()
 	defer app.mu.Unlock()
 	devices, ok := app.serialDevicesBySubModuleID[targetModuleID]
-	if !ok {
-		return util.NewError(_const.CommonException, _const.Device, errors.New("map key not exist"))
+	if !ok || len(*devices) == 0 {
+		// 没有对应模块 则直接返回 且向上层抛出错误
+		err := util.NewError(_const.CommonException, _const.Device, errors.New("map key not exist"))
+		app.publish(Event{Kind: EventSendFailed, ModuleID: targetModuleID}, _const.CommonException, err)
+		return nil, err
 	}
-	// 没有对应模块 则直接返回 且向上层抛出错误
-	for device_ := range *devices {
-		device := (*devices)[device_]
-		app.readyToSendToDevice(channel, targetModuleID, targetFunction, device.COM, data)
+	targets := make([]*SerialDevice, 0, len(*devices))
+	for _, device := range *devices {
+		targets = append(targets, device)
 	}
-	return nil
+	return targets, nil
 }
 
-// 预备发送数据到指定端口的下位机
-// 传入：目标模块ID,目标功能，COM，数据
-// 传出：无
-func (app *SerialApp) readyToSendToDevice(channel *SerialChannel, targetModuleID uint32, targetFunction string, COM string, data *[]byte) {
-	// 分配数据缓存标号
-	data_ := make([]byte, 0)
-	data_ = append(data_, Uint32ToBytes(targetModuleID)...)
-	data_ = append(data_, []byte(targetFunction)...)
-	data_ = append(data_, *data...)
-	// 加入发送序列
-	id := app.sendBuffer.RegisterSendData(COM, channel, &data_)
-	app.sendBuffer.ReadySend(COM, channel, id)
+// 预备发送数据到指定端口的下位机 在该下位机的端口线程中调用
+// 传入：目标模块ID,目标功能，下位机，数据
+// 传出：装入发送缓存的数据块，错误
+func (app *SerialApp) readyToSendToDevice(channel *SerialChannel, targetModuleID uint32, targetFunction string, device *SerialDevice, data *[]byte) (*SendDataBuffer, error) {
+	message := &SerialMessage{
+		TargetModuleID: targetModuleID,
+		TargetFunction: targetFunction,
+		Data:           *data,
+	}
+	// 装入消息信封 按照模块的配置压缩
+	data_, isCompressed, err := encodeSerialMessage(message, app.chooseCompression(device, targetModuleID, len(*data)))
+	if err != nil {
+		return nil, err
+	}
+	if isCompressed {
+		device.stats.countCompressed(len(*data) - (len(data_) - envelopeHeaderLen - len(targetFunction)))
+	}
+	data_ = device.sealEnvelope(data_)
+	// 接收方拒绝总帧数超过maxFrameNum的数据报 紧凑帧头还受限于16位的总帧数字段
+	fragmentLen := device.codec.fragmentLen(len(data_))
+	if fragmentLen == 0 || (uint32(len(data_))+fragmentLen-1)/fragmentLen > device.codec.frameNumLimit() {
+		return nil, util.NewError(_const.TrivialException, _const.Device, errors.New("MessageTooLong"))
+	}
+	// 分配数据缓存标号 加入发送序列 所有编号都在使用时不能覆盖还没有结果的数据块
+	if device.sendBuffer.isFull() {
+		return nil, util.NewError(_const.TrivialException, _const.Device, ErrSendBufferFull)
+	}
+	id := device.sendBuffer.RegisterSendData(channel, &data_)
+	send := device.sendBuffer.sendBuffer[id]
+	send.message = message
+	if device.profile != nil && device.profile.ARQ {
+		send.enableARQ()
+	}
+	device.sendBuffer.ReadySend(id)
+	return send, nil
 }
 
 // 发送数据给下位机
-// 传入：COM口，数据
+// 传入：下位机，数据
 // 传出：无
-func (app *SerialApp) sendToDevice(COM string, data *[]byte) error {
-	// 返回状态数据报
-	device := app.serialDevicesByCOM[COM]
+func (app *SerialApp) sendToDevice(device *SerialDevice, data *[]byte) error {
 	// 向串口写入
-	_, err := device.portIO.Write(*data)
+	_, err := app.getPortIO(device).Write(*data)
 	if err != nil {
 		return util.NewError(_const.CommonException, _const.Device, errors.New("SendFailed"))
 	}
 	return err
 }
 
-// StartSendMessage 监听管道讯息 把准备发送的讯息发送到下位机
+// 绕过发送缓存直接发送一条讯息 用于初始化协商等控制讯息 在该下位机的端口线程中调用
+// 传入：下位机，讯息
+// 传出：错误
+func (app *SerialApp) sendControlMessage(device *SerialDevice, msg *SerialMessage) error {
+	data, err := EncodeSerialMessage(msg)
+	if err != nil {
+		return err
+	}
+	frames, err := device.codec.encodeEnvelope(device.sealEnvelope(data), device.sendBuffer.nextControlBufferID())
+	if err != nil {
+		return err
+	}
+	for i := range frames {
+		err = app.sendToDevice(device, &frames[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartSendMessage 监听管道讯息 把准备发送的讯息发送到下位机 已经在发送时先停止之前的发送线程
 // 传入：moduleID
 // 传出：无
 func (app *SerialApp) StartSendMessage(moduleID uint32) {
-	serialChannel := app.serialChannelByNodeModulesID[moduleID]
-	go func() {
+	app.mu.Lock()
+	serialChannel, ok := app.serialChannelByNodeModulesID[moduleID]
+	if !ok {
+		app.mu.Unlock()
+		return
+	}
+	// 每次启动使用新的停止管道 停止时关闭它 同一个通道只保留一个发送线程
+	close(*serialChannel.stopSendDataChannel)
+	stop := make(chan struct{})
+	serialChannel.stopSendDataChannel = &stop
+	app.mu.Unlock()
+	app.goFunc(func() {
 		for {
 			select {
 			case data := <-*serialChannel.SendDataChannel:
-				// 如果出错 则录入错误数据库
-				err := app.send(serialChannel, data.TargetModuleID, data.TargetFunction, &data.Data)
-				if err != nil {
-					// todo:err
-				}
-			case <-*serialChannel.stopSendDataChannel:
-				break
-			default:
-				continue
+				// 错误已经发布为事件
+				_ = app.send(serialChannel, data.TargetModuleID, data.TargetFunction, &data.Data)
+			case <-stop:
+				return
+			case <-app.ctx.Done():
+				return
 			}
 		}
-	}()
+	})
 }
 
-// StopSendMessage 终止某个SerialChannel的发送
+// StopSendMessage 终止某个SerialChannel的发送 发送线程没有运行时不做任何事
 // 传入：moduleID
 // 传出：无
 func (app *SerialApp) StopSendMessage(moduleID uint32) {
-	*app.serialChannelByNodeModulesID[moduleID].stopSendDataChannel <- struct{}{}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	serialChannel, ok := app.serialChannelByNodeModulesID[moduleID]
+	if !ok {
+		return
+	}
+	close(*serialChannel.stopSendDataChannel)
+	stop := make(chan struct{})
+	serialChannel.stopSendDataChannel = &stop
 }
 
-// StopListenMessage 终止对单个下位机的传入数据的监听
+// StopListenMessage 终止对单个下位机的传入数据的监听 并丢弃端口中尚未读取的数据 没有在监听时不做任何事
 // 传入：COM
 // 传出：无
 func (app *SerialApp) StopListenMessage(COM string) {
-	app.revBuffer.revFuncStopChannels[COM] <- struct{}{}
+	_ = app.callDevice(COM, func(device *SerialDevice) error {
+		if device.actor.reads != nil {
+			device.actor.stopListening(app.getPortIO(device).Flush())
+		}
+		return nil
+	})
 }
 
 // StopAllListenMessage 终止对所有下位机的传入数据的监听
 // 传入：无
 // 传出：无
 func (app *SerialApp) StopAllListenMessage() {
-	for COM, _ := range app.serialDevicesByCOM {
+	for _, COM := range app.getCOMs() {
 		app.StopListenMessage(COM)
 	}
 }
 
 // StartAllListenMessage 监听下位机传入数据 把下位机内的数据传递到指定模块
+// 无法开始监听的下位机发布EventStartFailed 同时返回其错误 监听之后因为读取出错而结束时发布EventListenStopped
 // 传入：无
-// 传出：无
+// 传出：无法开始监听的错误
 func (app *SerialApp) StartAllListenMessage() *[]error {
 	errs := make([]error, 0)
-	for COM, _ := range app.serialDevicesByCOM {
-		COM := COM
-		go func() {
-			err := app.ListenMessagePerDevice(COM, time.Now().UnixMilli())
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}()
-		//如果出错则返回给调用函数
+	for _, COM := range app.getCOMs() {
+		err := app.startListening(COM, nil)
+		if err != nil {
+			app.publish(Event{Kind: EventStartFailed, COM: COM}, _const.CommonException, err)
+			errs = append(errs, err)
+		}
 	}
 	return &errs
 }
 
 // ListenMessagePerDevice 监听单个下位机传入的原始讯息 并在分析后传递到指定模块
-// 同时 其会每隔一段时间就清除过期的buffer 为了避免线程安全问题 这两个功能被放在一个线程以内
+// 读到的数据由该下位机的端口线程处理 它同时会每隔一段时间就清除过期的buffer
+// 阻塞直到调用StopListenMessage 读取端口出错 或者SerialApp关闭
 // 传入：下位机COM口，上一次清理buffer时间
-// 传出：无
+// 传出：读取端口或者丢弃端口数据时的错误
 func (app *SerialApp) ListenMessagePerDevice(COM string, lastCleanBufferTime int64) error {
-	// 从串口读取的缓存
+	result := make(chan error, 1)
+	err := app.startListening(COM, result)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-result:
+		return err
+	case <-app.ctx.Done():
+		return nil
+	}
+}
+
+// 让某个下位机的端口线程开始监听
+// 传入：COM，监听结束时返回结果的管道 可以为nil
+// 传出：错误
+func (app *SerialApp) startListening(COM string, result chan error) error {
+	return app.callDevice(COM, func(device *SerialDevice) error {
+		return device.actor.startListening(result)
+	})
+}
+
+// 读取串口的线程 读到的数据交给端口线程 读取超时时继续阻塞读取
+// 线路配置在运行时修改后端口线程会为新的端口启动新的读取线程
+// 传入：端口，读到的数据，读取错误，监听结束的通知
+// 传出：无
+func (app *SerialApp) readPort(portIO Transport, reads chan<- []byte, readErr chan<- error, done <-chan struct{}) {
 	listenBuffer := make([]byte, _const.PortLen)
-	// 一个数据报在之前读取的数据的有效长度
-	lastRead := 0
-	// 之前读取的数据
-	lastBuffer := make([]byte, _const.PortLen)
-	// 每次读取都是把上次读取的长度和这次读取的加起来 直到达到portLen
 	for {
 		select {
-		case <-app.revBuffer.revFuncStopChannels[COM]:
-			err := app.serialDevicesByCOM[COM].portIO.Flush()
-			if err != nil {
-				return err
-			}
-			//todo:err
-			break
+		case <-done:
+			return
+		case <-app.ctx.Done():
+			return
 		default:
-			nowTime := time.Now().UnixMilli()
-			// 清理超时revBuffer
-			for bufferID, lastTime := range *app.revBuffer.revBufferHangingPeriod[COM] {
-				if (nowTime - lastTime) > app.RevBufferWaitTimeOut {
-					delete(*app.revBuffer.revBufferResidue[COM], bufferID)
-					delete(*app.revBuffer.revBuffer[COM], bufferID)
-					delete(*app.revBuffer.revBufferHangingPeriod[COM], bufferID)
-				}
-			}
-			// 读取串口
-			read, err := app.serialDevicesByCOM[COM].portIO.Read(listenBuffer)
-			if read > 0 {
-				lastRead = read
-				if err != nil {
-					return err
-					//todo:处理错误
-				}
-				// 如果加上这次读取的还是不够一个数据报的长度 则继续读取
-				if lastRead+read < int(_const.PortLen) {
-					lastRead += read
-					lastBuffer = append(lastBuffer[:lastRead], listenBuffer[:read]...)
-					// 如果刚好是一个数据报
-				} else if lastRead+read == int(_const.PortLen) {
-					// 将该数据呈递给缓冲区
-					dataBuffer := append(lastBuffer[:lastRead], listenBuffer[:read]...)
-					lastRead = 0
-					lastBuffer = make([]byte, _const.PortLen)
-					data := InitRevDataBuffer(&dataBuffer)
-					err := app.revBuffer.submitDataFrame(COM, data)
-					if err != nil {
-						return err
-						//todo:err
-					}
-				} else {
-					// 截断数据 然后提交给缓冲区
-					dataBuffer := append(lastBuffer[:lastRead], listenBuffer[:(int)(_const.PortLen)-lastRead]...)
-					lastBuffer = append(listenBuffer[((int)(_const.PortLen) - lastRead):read])
-					lastRead = (int)(_const.PortLen) - lastRead
-					data := InitRevDataBuffer(&dataBuffer)
-					err := app.revBuffer.submitDataFrame(COM, data)
-					if err != nil {
-						return err
-						//todo:err
-					}
-				}
-			}
+		}
+		read, err := portIO.Read(listenBuffer)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		if read == 0 {
 			continue
 		}
+		data := make([]byte, read)
+		copy(data, listenBuffer[:read])
+		select {
+		case reads <- data:
+		case <-done:
+			return
+		case <-app.ctx.Done():
+			return
+		}
 	}
 }
 
-// StartAllSendChannels 开始所有发送线程
-// 传入：无
+// 处理接收器中已经切分出的数据帧 在该下位机的端口线程中调用
+// 传入：下位机，接收器
 // 传出：无
-func (sendBuffer *SendBuffer) StartAllSendChannels() []error {
+func (app *SerialApp) handleReceivedFrames(device *SerialDevice, receiver *frameReceiver) {
+	isARQ := device.profile != nil && device.profile.ARQ
+	for {
+		frame, ok, err := receiver.next()
+		if !ok {
+			return
+		}
+		// 校验失败但帧头可信的数据帧要求重发 其余的解码错误直接丢弃
+		var frameErr *FrameError
+		if errors.Is(err, ErrFrameChecksum) && errors.As(err, &frameErr) && frameErr.Frame != nil {
+			device.stats.resendRequests.Add(1)
+			device.revBuffer.requestResend(frameErr.Frame)
+			continue
+		}
+		if err != nil {
+			app.publish(Event{Kind: EventFrameDropped, COM: device.COM}, _const.TrivialException, err)
+			continue
+		}
+		// 单个数据报的错误不中断监听 帧头超出范围的数据帧计入统计后丢弃
+		event := Event{COM: device.COM, HasFrame: true, BufferID: frame.BufferID, FrameID: frame.FrameID}
+		rev, err := InitRevDataBuffer(frame)
+		if err == nil {
+			err = device.revBuffer.submitDataFrame(rev)
+		}
+		if errors.Is(err, ErrFrameHeader) {
+			device.stats.malformedFrames.Add(1)
+		} else if isARQ && !isControlBufferID(frame.BufferID) {
+			// 放入接收缓存的数据帧都需要确认 包括重复收到的 以免确认丢失后下位机一直重发
+			event.Kind = EventWriteFailed
+			app.publish(event, _const.CommonException, app.sendFrameAck(device, frame))
+		}
+		event.Kind = EventFrameDropped
+		app.publish(event, _const.TrivialException, err)
+	}
+}
+
+// 获取某个下位机当前的传输 读取线程在端口线程之外使用它 线路配置修改后会被替换
+// 传入：下位机
+// 传出：传输
+func (app *SerialApp) getPortIO(device *SerialDevice) Transport {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return device.portIO
+}
+
+// StartAllSendChannels 开始所有下位机的发送
+// 传入：无
+// 传出：错误
+func (app *SerialApp) StartAllSendChannels() []error {
 	var errs = make([]error, 0)
-	for COM, _ := range sendBuffer.app.serialDevicesByCOM {
-		err := sendBuffer.StartSendChannel(COM)
+	for _, COM := range app.getCOMs() {
+		err := app.StartSendChannel(COM)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -277,94 +472,169 @@ func (sendBuffer *SendBuffer) StartAllSendChannels() []error {
 	return errs
 }
 
-// StopAllSendChannels 取消所有发送线程
+// StopAllSendChannels 取消所有下位机的发送
 // 传入：无
 // 传出：无
-func (sendBuffer *SendBuffer) StopAllSendChannels() {
-	for _, v := range sendBuffer.sendFuncStopChannels {
-		*v <- struct{}{}
+func (app *SerialApp) StopAllSendChannels() {
+	for _, COM := range app.getCOMs() {
+		app.StopSendChannel(COM)
 	}
 }
 
-// StartSendChannel 加入一个发送线程 通过COM 并发开始发送 每个发送线程都是发送该线程对应的COM的讯息
+// StartSendChannel 让一个COM的端口线程开始轮转发送该COM的讯息 端口没有打开过时返回ErrPortNotOpen
+// 传入：COM
+// 传出：错误
+func (app *SerialApp) StartSendChannel(COM string) error {
+	return app.callDevice(COM, func(device *SerialDevice) error {
+		if app.getPortIO(device) == nil {
+			return util.NewError(_const.TrivialException, _const.Device, ErrPortNotOpen)
+		}
+		device.actor.isSending = true
+		return nil
+	})
+}
+
+// StopSendChannel 让一个COM的端口线程停止发送 已经装入发送缓存的讯息在重新开始后继续发送
 // 传入：COM
 // 传出：无
+func (app *SerialApp) StopSendChannel(COM string) {
+	_ = app.callDevice(COM, func(device *SerialDevice) error {
+		device.actor.isSending = false
+		return nil
+	})
+}
+
+// StartAllSendChannels 开始所有下位机的发送
+// Deprecated: 发送缓冲器属于单个下位机 使用SerialApp.StartAllSendChannels
+// 传入：无
+// 传出：错误
+func (sendBuffer *SendBuffer) StartAllSendChannels() []error {
+	return sendBuffer.app.StartAllSendChannels()
+}
+
+// StopAllSendChannels 取消所有下位机的发送
+// Deprecated: 发送缓冲器属于单个下位机 使用SerialApp.StopAllSendChannels
+// 传入：无
+// 传出：无
+func (sendBuffer *SendBuffer) StopAllSendChannels() {
+	sendBuffer.app.StopAllSendChannels()
+}
+
+// StartSendChannel 让一个COM的端口线程开始轮转发送该COM的讯息
+// Deprecated: 发送缓冲器属于单个下位机 使用SerialApp.StartSendChannel
+// 传入：COM
+// 传出：错误
 func (sendBuffer *SendBuffer) StartSendChannel(COM string) error {
-	_, ok := sendBuffer.readySendBuffer[COM]
-	if !ok {
-		return util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	return sendBuffer.app.StartSendChannel(COM)
+}
+
+// StopSendChannel 让一个COM的端口线程停止发送
+// Deprecated: 发送缓冲器属于单个下位机 使用SerialApp.StopSendChannel
+// 传入：COM
+// 传出：无
+func (sendBuffer *SendBuffer) StopSendChannel(COM string) {
+	sendBuffer.app.StopSendChannel(COM)
+}
+
+// 定时清理缓冲区的间隔 超时时间的四分之一 至少为10毫秒
+// 传入：超时时间 毫秒
+// 传出：间隔
+func expiryInterval(timeout int64) time.Duration {
+	interval := time.Duration(timeout) * time.Millisecond / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
 	}
-	stopChannel := make(chan struct{})
-	*sendBuffer.sendFuncStopChannels[COM] = stopChannel
-	go sendBuffer.sendFunc(stopChannel, COM)
-	return nil
+	return interval
+}
+
+// 一轮轮转中需要发送的数据帧
+type roundFrame struct {
+	// 所属的数据块
+	send *SendDataBuffer
+	// 数据帧号
+	frameID uint32
+	// 数据
+	data *[]byte
 }
 
 /*
- 数据的格式是 数据报编号[32位] 数据报帧号[32位] 数据报总帧数[32位] 数据报实际长度[32位](也就是这个数据报内要截取多少 只包含有效数据的长度)  数据[] 补0 奇校验码[8位] 一帧总长度是固定的
+ 数据帧的格式由FrameCodec决定 见codec.go
 */
-// 发送线程，这个线程会轮转式的，向下位机发送被注册的，需要发送的数据报
-// 传入：COM
-// 传出：无
-func (sendBuffer *SendBuffer) sendFunc(stopChan chan struct{}, COM string) {
-	for {
-		select {
-		case <-stopChan:
-			break
-		default:
-			// 执行删除超时发送的数据报的任务
-			nowTime := time.Now().UnixMilli()
-			for bufferID, lastTime := range *sendBuffer.sendBufferWaitTime[COM] {
-				if nowTime-lastTime > sendBuffer.app.SendBufferWaitTimeOut {
-					delete(*sendBuffer.sendBuffer[COM], bufferID)
-					delete(*sendBuffer.sendBufferWaitTime[COM], bufferID)
-					delete(*sendBuffer.readySendBuffer[COM], bufferID)
-				}
+// 取出一轮轮转中需要发送的数据帧 每个预备发送的数据块各出一帧 已经发完的数据块进入等待删除的状态
+// 逐帧确认的数据块在所有数据帧被确认之前一直留在预备发送缓冲区中 见arq.go
+// 传入：无
+// 传出：需要发送的数据帧，下一次需要检查确认超时的时间 毫秒（为0时不需要）
+func (sendBuffer *SendBuffer) nextRound() ([]roundFrame, int64) {
+	app := sendBuffer.app
+	app.mu.Lock()
+	ackTimeout := app.ackTimeout.Milliseconds()
+	app.mu.Unlock()
+	// 执行删除超时发送的数据报的任务
+	nowTime := time.Now().UnixMilli()
+	device := sendBuffer.device
+	// 确认超时要加上排在前面的数据帧的传输时间 在途的数据帧数还受发送窗口的限制
+	inFlight := 0
+	for _, send := range sendBuffer.readySendBuffer {
+		if send.isARQ {
+			inFlight += send.inFlight()
+		}
+	}
+	for bufferID, lastTime := range sendBuffer.sendBufferWaitTime {
+		if nowTime-lastTime > app.SendBufferWaitTimeOut {
+			sendBuffer.removeSendData(bufferID, util.NewError(_const.CommonException, _const.Device, ErrSendBufferTimeOut))
+		}
+	}
+	// 执行轮转发送数据片的任务
+	frames := make([]roundFrame, 0)
+	for bufferID, send := range sendBuffer.readySendBuffer {
+		if send.isARQ {
+			canSendNew := device.canSendNewFrame(inFlight, nowTime, ackTimeout)
+			frameID, ok, failedFrameID := send.nextARQFrame(nowTime, app.maxResendTimes, canSendNew)
+			if failedFrameID >= 0 {
+				sendBuffer.failSendData(send, uint32(failedFrameID), EventResendExceeded,
+					util.NewError(_const.CommonException, _const.Device, ErrResendTimesExceeded))
+				continue
+			}
+			if !ok {
+				continue
 			}
-			// 执行轮转发送数据片的任务 e
-			for _, send := range *sendBuffer.readySendBuffer[COM] {
-				// 发送数据帧
-				err, frameID, frame := (*send).nextDataFrame()
-				err = sendBuffer.app.sending(COM, send, frameID, frame)
-				if err != nil {
-					return
-
-				}
-				//todo:err
+			if send.sendTimes[frameID] > 0 {
+				device.stats.retransmittedFrames.Add(1)
+			} else {
+				inFlight++
 			}
+			send.sendTimes[frameID]++
+			send.deadlines[frameID] = nowTime + ackTimeout + device.frameAirtime()*int64(inFlight)
+			frames = append(frames, roundFrame{send: send, frameID: frameID, data: send.getFrame(frameID)})
 			continue
 		}
+		err, frameID, frame := send.nextDataFrame()
+		if err != nil {
+			// 已经发完 保留在发送缓冲区中以备重传 超时后删除
+			delete(sendBuffer.readySendBuffer, bufferID)
+			sendBuffer.sendBufferWaitTime[bufferID] = nowTime
+			send.finish(nil)
+			continue
+		}
+		frames = append(frames, roundFrame{send: send, frameID: frameID, data: frame})
 	}
+	return frames, sendBuffer.nextWakeTime(ackTimeout)
 }
 
 // 发送消息数据帧
 
 // 发送数据帧
-// 传入：COM string, send *SendDataBuffer, frameID uint32, frame *[]byte
+// 传入：下位机, send *SendDataBuffer, frameID uint32, frame *[]byte
 // 传出：error
-func (app *SerialApp) sending(COM string, send *SendDataBuffer, frameID uint32, frame *[]byte) error {
-	sendFrame := make([]byte, 0)
-	// 将数据的各个段的内容加入
-	// 加入实际数据长度
-	sendFrame = append(Uint32ToBytes((uint32)(len(*frame))), *frame...)
-	// 加入总帧数
-	sendFrame = append(Uint32ToBytes((*send).frameNum), sendFrame...)
-	// 加入帧ID
-	sendFrame = append(Uint32ToBytes(frameID), sendFrame...)
-	// 加入缓冲ID
-	sendFrame = append(Uint32ToBytes((*send).bufferID), sendFrame...)
-	// 补零
-	zeros := make([]byte, int(_const.PortLen)-len(*frame)-1)
-	sendFrame = append(sendFrame, zeros...)
-	sendFrame = append(sendFrame, CalculateOddParity(&sendFrame))
-	err := app.sendToDevice(COM, &sendFrame)
-	return err
-}
-
-// StopSendChannel 取消一个COM的发送线程 通过COM
-// 传入：无
-// 传出：无
-func (sendBuffer *SendBuffer) StopSendChannel(COM string) {
-	*sendBuffer.sendFuncStopChannels[COM] <- struct{}{}
-	delete(sendBuffer.sendFuncStopChannels, COM)
+func (app *SerialApp) sending(device *SerialDevice, send *SendDataBuffer, frameID uint32, frame *[]byte) error {
+	sendFrame, err := device.codec.EncodeFrame(&Frame{
+		BufferID: send.bufferID,
+		FrameID:  frameID,
+		FrameNum: send.frameNum,
+		Payload:  *frame,
+	})
+	if err != nil {
+		return err
+	}
+	return app.sendToDevice(device, &sendFrame)
 }
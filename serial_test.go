@@ -0,0 +1,54 @@
+package device_test
+
+import (
+	"bytes"
+	"testing"
+
+	device "github.com/238Studio/child-nodes-device-service"
+)
+
+func TestSerialMessageEnvelope(t *testing.T) {
+	message := &device.SerialMessage{TargetModuleID: 0x01020304, TargetFunction: "SetSpeed", Data: []byte{0, 1, 2}}
+	data, err := device.EncodeSerialMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := device.ParseDataToSerialMessage(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.TargetModuleID != message.TargetModuleID || parsed.TargetFunction != message.TargetFunction || !bytes.Equal(parsed.Data, message.Data) {
+		t.Fatalf("消息信封往返后不一致: %+v", parsed)
+	}
+	// 没有数据的讯息
+	empty, _ := device.EncodeSerialMessage(&device.SerialMessage{TargetModuleID: 7})
+	parsed, err = device.ParseDataToSerialMessage(&empty)
+	if err != nil || parsed.TargetFunction != "" || len(parsed.Data) != 0 {
+		t.Fatal("空讯息解析错误")
+	}
+}
+
+func TestSerialMessageEnvelopeMalformed(t *testing.T) {
+	if _, err := device.EncodeSerialMessage(&device.SerialMessage{TargetFunction: string(make([]byte, 256))}); err == nil {
+		t.Fatal("过长的功能名应当返回错误")
+	}
+	malformed := [][]byte{
+		{},
+		{0, 0, 0, 1},
+		{0, 0, 0, 1, 0},
+		// 功能名长度超出数据
+		{0, 0, 0, 1, 0, 9, 'a', 'b'},
+		// 未知的标志位
+		{0, 0, 0, 1, 0x80, 0},
+		// 未知的压缩算法
+		{0, 0, 0, 1, 0x0F, 0},
+		// 损坏的压缩数据
+		{0, 0, 0, 1, byte(device.CompressionFlate), 0, 0xff, 0xff, 0xff},
+	}
+	for _, data := range malformed {
+		data := data
+		if _, err := device.ParseDataToSerialMessage(&data); err == nil {
+			t.Fatalf("畸形的消息信封应当返回错误: %v", data)
+		}
+	}
+}
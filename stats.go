@@ -0,0 +1,109 @@
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+	"github.com/238Studio/child-nodes-assist/util"
+)
+
+// LinkStats 单个下位机链路的统计
+type LinkStats struct {
+	// 字节流错位或者损坏后重新同步的次数
+	Resyncs uint64
+	// 重新同步时丢弃的字节数
+	DiscardedBytes uint64
+	// 压缩后发送的讯息数
+	CompressedMessages uint64
+	// 压缩节省的字节数
+	CompressionSavedBytes uint64
+	// 认证失败被丢弃的讯息数
+	AuthFailures uint64
+	// 重放被丢弃的讯息数
+	Replays uint64
+	// 前向纠错纠正的数据帧数
+	CorrectedFrames uint64
+	// 前向纠错纠正的字节数
+	CorrectedBytes uint64
+	// 校验失败要求下位机重发的数据帧数
+	ResendRequests uint64
+	// 通过校验但帧头超出范围被丢弃的数据帧数
+	MalformedFrames uint64
+	// 重组后无法解析或者没有对应模块被丢弃的讯息数
+	DroppedMessages uint64
+	// 确认超时后重发的数据帧数
+	RetransmittedFrames uint64
+	// 重发次数达到上限被放弃的讯息数
+	FailedMessages uint64
+}
+
+// 链路统计的计数器 由监听线程更新 其他线程读取
+type linkStats struct {
+	// 重新同步的次数
+	resyncs atomic.Uint64
+	// 丢弃的字节数
+	discardedBytes atomic.Uint64
+	// 压缩后发送的讯息数
+	compressedMessages atomic.Uint64
+	// 压缩节省的字节数
+	compressionSavedBytes atomic.Uint64
+	// 认证失败的讯息数
+	authFailures atomic.Uint64
+	// 重放的讯息数
+	replays atomic.Uint64
+	// 纠正的数据帧数
+	correctedFrames atomic.Uint64
+	// 纠正的字节数
+	correctedBytes atomic.Uint64
+	// 要求重发的数据帧数
+	resendRequests atomic.Uint64
+	// 帧头超出范围的数据帧数
+	malformedFrames atomic.Uint64
+	// 被丢弃的讯息数
+	droppedMessages atomic.Uint64
+	// 重发的数据帧数
+	retransmittedFrames atomic.Uint64
+	// 被放弃的讯息数
+	failedMessages atomic.Uint64
+}
+
+// 获取统计的快照
+// 传入：无
+// 传出：统计
+func (stats *linkStats) snapshot() LinkStats {
+	return LinkStats{
+		Resyncs:               stats.resyncs.Load(),
+		DiscardedBytes:        stats.discardedBytes.Load(),
+		CompressedMessages:    stats.compressedMessages.Load(),
+		CompressionSavedBytes: stats.compressionSavedBytes.Load(),
+		AuthFailures:          stats.authFailures.Load(),
+		Replays:               stats.replays.Load(),
+		CorrectedFrames:       stats.correctedFrames.Load(),
+		CorrectedBytes:        stats.correctedBytes.Load(),
+		ResendRequests:        stats.resendRequests.Load(),
+		MalformedFrames:       stats.malformedFrames.Load(),
+		DroppedMessages:       stats.droppedMessages.Load(),
+		RetransmittedFrames:   stats.retransmittedFrames.Load(),
+		FailedMessages:        stats.failedMessages.Load(),
+	}
+}
+
+// 记录一条压缩后发送的讯息
+// 传入：节省的字节数
+// 传出：无
+func (stats *linkStats) countCompressed(saved int) {
+	stats.compressedMessages.Add(1)
+	stats.compressionSavedBytes.Add(uint64(saved))
+}
+
+// GetLinkStats 获取某个下位机链路的统计
+// 传入：下位机COM
+// 传出：统计，错误
+func (app *SerialApp) GetLinkStats(COM string) (LinkStats, error) {
+	device, ok := app.getDevice(COM)
+	if !ok {
+		return LinkStats{}, util.NewError(_const.TrivialException, _const.Device, errors.New("NoSuchCOM"))
+	}
+	return device.stats.snapshot(), nil
+}
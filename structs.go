@@ -1,7 +1,9 @@
 package device
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tarm/serial"
@@ -10,16 +12,51 @@ import (
 // 子节点模块
 
 // SerialDevice 对应了单个下位机的串口收发类
+// 注册之后 除了传输和统计之外的状态都由该下位机的端口线程独占 见actor.go
 type SerialDevice struct {
-	// 该串口配置
+	// 该串口的线路配置
+	lineConfig LineConfig
+	// 由线路配置生成的串口配置
 	serialConfig serial.Config
-	// 串口号
+	// 串口号 可以是COM3这样的名字 也可以是/dev/ttyUSB0这样的路径
 	COM string
-	// 串口通讯
-	portIO *serial.Port
+	// 握手时分配的一字节编号 下位机通过它标识自己
+	deviceID byte
+	// 数据帧编解码器
+	codec *FrameCodec
+	// 下位机声明的能力 为nil时说明是没有声明能力的旧固件
+	capability *deviceCapability
+	// 协商出的链路参数 协商之前为nil
+	profile *Profile
+	// 协商失败的原因
+	negotiateErr error
+	// 链路统计
+	stats *linkStats
+	// 发送窗口 也就是最近一次通告的接收窗口 见window.go
+	sendWindow uint32
+	// 最近一次通告接收窗口的时间 毫秒
+	windowUpdatedAt int64
+	// 预共享密钥 为nil时不认证
+	authKey []byte
+	// 最近一次握手的随机数 见auth.go
+	authNonce []byte
+	// 发出的最大序列号
+	sendSeq atomic.Uint64
+	// 收到的序列号的重放窗口
+	revWindow replayWindow
+	// 发送缓存
+	sendBuffer *SendBuffer
+	// 接收缓存
+	revBuffer *RevBuffer
+	// 端口线程
+	actor *portActor
+	// 串口通讯 可以是真实串口 也可以是其它实现了Transport的传输 由app.mu保护
+	portIO Transport
+	// 打开传输的方法 为nil时打开真实串口
+	opener TransportOpener
 	// 该串口对应的下位机功能模块（注意 不是实际模块 而是注册的功能模块） moduleID
 	SubModuleID []uint32
-	// 是否处于连接状态
+	// 是否处于连接状态 由app.mu保护
 	isConnected bool
 }
 
@@ -33,20 +70,52 @@ type SerialApp struct {
 	RevBufferWaitTimeOut int64
 	// 串口消息等待时间
 	ReadTimeout time.Duration
-	// 互斥锁
+	// 自动初始化时打开传输的方法 为nil时打开真实串口
+	transportOpener TransportOpener
+	// 按串口路径指定的线路配置 COM->LineConfig
+	lineConfigByCOM map[string]LineConfig
+	// 按USB厂商/产品ID指定的线路配置
+	lineConfigByUSB map[usbID]LineConfig
+	// 自动识别波特率时的候选波特率 为空时不识别
+	baudCandidates []int
+	// 自动识别波特率时每个波特率等待初始化应答的时间
+	baudDetectTimeout time.Duration
+	// 上位机支持的校验方式 按优先级从高到低排列
+	checksums []Checksum
+	// 上位机能够接受的数据帧长度上限
+	mtuLimit uint32
+	// 上位机接受的最低协议版本
+	minProtocolVersion byte
+	// 上位机支持的压缩算法
+	compressions []Compression
+	// 发往各个模块的讯息的压缩配置 moduleID->CompressionConfig
+	compressionByModule map[uint32]CompressionConfig
+	// 按串口路径指定的预共享密钥 COM->密钥
+	preSharedKeys map[string][]byte
+	// 互斥锁 只保护注册表 应用级配置和端口的传输 下位机的其它状态由端口线程独占
 	mu *sync.Mutex
 	// 从下位机的模块对应了若干个下位机的串口收发模块 NodeModuleID->SerialAppPerDevice
 	serialDevicesBySubModuleID map[uint32]*map[string]*SerialDevice
 	// COM->SerialAppPerDevice
 	serialDevicesByCOM map[string]*SerialDevice
-	// 是否运行
+	// 是否运行 也就是Run是否正在运行
 	isAlive bool
-	// 发送缓存
-	sendBuffer *SendBuffer
-	// 接收缓存
-	revBuffer *RevBuffer
-	// 最大发送尝试次数
+	// 生命周期 Close时结束
+	ctx context.Context
+	// 结束生命周期
+	cancel context.CancelFunc
+	// 生命周期内启动的线程
+	wg sync.WaitGroup
+	// 保证只关闭一次
+	closeOnce sync.Once
+	// 关闭端口时的错误
+	closeErr error
+	// 重发线程的停止管道
+	stopResendChannel chan struct{}
+	// 最大发送尝试次数 逐帧确认时每个数据帧最多发送的次数
 	maxResendTimes int
+	// 等待数据帧确认的基础时间
+	ackTimeout time.Duration
 	// 消息通道 通过子节点moduleID映射到
 	serialChannelByNodeModulesID map[uint32]*SerialChannel
 	// 数据报反馈通道 也就是发送给下位机消息的通道 主要用于返回错误
@@ -55,6 +124,10 @@ type SerialApp struct {
 	initDeviceChannel *SerialChannel
 	// 初始化数据中止通道
 	stopInitDeviceChannel *chan struct{}
+	// 握手编号分配器
+	portIDs *portIDAllocator
+	// 线程中发生的错误的订阅者
+	events *eventHub
 }
 
 // InitSerialDataProcessor 初始化模块的数据转换器
@@ -95,6 +168,8 @@ type SerialChannel struct {
 	SendDataChannel *chan *SerialMessage
 	// 中止发送数据通道
 	stopSendDataChannel *chan struct{}
+	// 发送失败的报告 逐帧确认的讯息重发次数达到上限时放入
+	SendFailedChannel *chan *SendFailure
 }
 
 // SendDataBuffer 发送数据缓存区，其中是将被发送的数据
@@ -107,22 +182,40 @@ type SendDataBuffer struct {
 	bufferID uint32
 	// 总数据帧量
 	frameNum uint32
+	// 每个数据帧承载的数据长度
+	payloadLen uint32
+	// 发送该数据报的消息通道
+	channel *SerialChannel
+	// 该数据报装载的讯息
+	message *SerialMessage
+	// 是否逐帧确认
+	isARQ bool
+	// 每个数据帧是否已经被确认
+	acked []bool
+	// 还没有被确认的数据帧数
+	unacked uint32
+	// 每个数据帧的确认超时时间 毫秒 为0时还没有发送
+	deadlines []int64
+	// 每个数据帧的发送次数
+	sendTimes []int
+	// 同步发送时通知数据报结果的管道 已经通知或者不是同步发送时为nil
+	done chan error
 }
 
-// SendBuffer 发送缓冲器
+// SendBuffer 一个下位机的发送缓冲器 由该下位机的端口线程独占
 type SendBuffer struct {
-	// 发送总缓冲区，每个COM口一个发送缓存区,这里存储了要通过这个COM口发送的数据。COM->bufferID->*DataBuffer
-	sendBuffer map[string]*map[uint32]*SendDataBuffer
-	// 预备发送缓冲区，这里的是正在轮换发送的数据 COM->bufferID->SendDataBuffer
-	readySendBuffer map[string]*map[uint32]*SendDataBuffer
-	// 发送数据空置时间 也就是说 它在完成发送后 最后一次收到数据回报多久 超过了某个时间段就会删除 COM->bufferID->*DataBuffer
-	sendBufferWaitTime map[string]*map[uint32]int64
+	// 发送总缓冲区，这里存储了要通过这个COM口发送的数据。bufferID->*DataBuffer
+	sendBuffer map[uint32]*SendDataBuffer
+	// 预备发送缓冲区，这里的是正在轮换发送的数据 bufferID->SendDataBuffer
+	readySendBuffer map[uint32]*SendDataBuffer
+	// 发送数据空置时间 也就是说 它在完成发送后 最后一次收到数据回报多久 超过了某个时间段就会删除 bufferID->time mil
+	sendBufferWaitTime map[uint32]int64
 	// 发送数据报计数器 用于唯一的标记每个数据报
 	i uint32
 	// 高优先级数据包发送计数器
 	j uint32
-	// 发送线程的停止管道 COM->chan
-	sendFuncStopChannels map[string]*chan struct{}
+	// 所属的下位机
+	device *SerialDevice
 	// App
 	app *SerialApp
 }
@@ -139,16 +232,16 @@ type RevDataBuffer struct {
 	frameNum uint32
 }
 
-// RevBuffer 发送缓冲器
+// RevBuffer 一个下位机的接收缓冲器 由该下位机的端口线程独占
 type RevBuffer struct {
-	// 接收总缓冲区，每个COM口一个接收缓存区,这里存储了要通过这个COM口接收的数据。COM->bufferID->*byte[]
-	revBuffer map[string]*map[uint32]*[]*[]byte
-	// 上一次接收数据的时间 某个buffer 单位是毫秒 COM->bufferID->time mil
-	revBufferHangingPeriod map[string]*map[uint32]int64
-	// 接收数据剩余计数器 也就是某个bufferID的数据还有多少没收到 COM->bufferID->剩余帧数
-	revBufferResidue map[string]*map[uint32]uint32
-	// 接收线程的停止管道 COM->chan
-	revFuncStopChannels map[string]chan struct{}
+	// 接收总缓冲区，这里存储了要通过这个COM口接收的数据。bufferID->*byte[]
+	revBuffer map[uint32]*[]*[]byte
+	// 上一次接收数据的时间 某个buffer 单位是毫秒 bufferID->time mil
+	revBufferHangingPeriod map[uint32]int64
+	// 接收数据剩余计数器 也就是某个bufferID的数据还有多少没收到 bufferID->剩余帧数
+	revBufferResidue map[uint32]uint32
+	// 所属的下位机
+	device *SerialDevice
 	// App
 	app *SerialApp
 }
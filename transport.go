@@ -0,0 +1,118 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// 传输类型
+const (
+	// TransportSerial 真实的串口
+	TransportSerial = "serial"
+	// TransportPipe 内存管道
+	TransportPipe = "pipe"
+)
+
+// Transport 下位机的底层传输 串口设备通过它收发原始字节
+// 除了真实的串口以外 也可以是伪终端 TCP连接或者内存管道
+type Transport interface {
+	// Read 读取数据 超时后可以返回0字节且不返回错误
+	Read(p []byte) (int, error)
+	// Write 写入数据
+	Write(p []byte) (int, error)
+	// Flush 丢弃还没有被收发的缓存数据
+	Flush() error
+	// Close 关闭传输
+	Close() error
+	// Info 获取传输的元数据
+	Info() TransportInfo
+}
+
+// TransportInfo 传输的元数据
+type TransportInfo struct {
+	// 传输类型 例如serial pipe
+	Kind string
+	// 端点名 例如串口路径或者网络地址
+	Name string
+	// 波特率 非串口传输时为0
+	Baud int
+}
+
+// TransportOpener 根据串口配置打开一个传输
+// 传入：串口配置
+// 传出：传输，错误
+type TransportOpener func(config *serial.Config) (Transport, error)
+
+// 基于tarm/serial的串口传输
+type serialTransport struct {
+	// 串口
+	port *serial.Port
+	// 打开串口时使用的配置
+	config serial.Config
+}
+
+// 串口读取的最长等待时间 没有设置ReadTimeout时以此轮询
+// 阻塞的串口读取无法被关闭串口唤醒 没有上限时Close会一直等待监听线程退出
+const serialPollTimeout = 100 * time.Millisecond
+
+// OpenSerialTransport 打开一个真实的串口传输 这是下位机默认的传输方式
+// 没有设置ReadTimeout时以serialPollTimeout轮询 读取超时返回0字节
+// 传入：串口配置
+// 传出：传输，错误
+func OpenSerialTransport(config *serial.Config) (Transport, error) {
+	portConfig := *config
+	if portConfig.ReadTimeout <= 0 {
+		portConfig.ReadTimeout = serialPollTimeout
+	}
+	port, err := serial.OpenPort(&portConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &serialTransport{port: port, config: portConfig}, nil
+}
+
+// Read 读取串口 设置了ReadTimeout时 超时会以0字节的EOF返回 这里将其视为普通的超时
+// 传入：缓存
+// 传出：读取长度，错误
+func (transport *serialTransport) Read(p []byte) (int, error) {
+	n, err := transport.port.Read(p)
+	if n == 0 && errors.Is(err, io.EOF) && transport.config.ReadTimeout > 0 {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Write 写入串口
+// 传入：数据
+// 传出：写入长度，错误
+func (transport *serialTransport) Write(p []byte) (int, error) {
+	return transport.port.Write(p)
+}
+
+// Flush 清空串口缓存
+// 传入：无
+// 传出：错误
+func (transport *serialTransport) Flush() error {
+	return transport.port.Flush()
+}
+
+// Close 关闭串口
+// 传入：无
+// 传出：错误
+func (transport *serialTransport) Close() error {
+	return transport.port.Close()
+}
+
+// Info 获取串口元数据
+// 传入：无
+// 传出：元数据
+func (transport *serialTransport) Info() TransportInfo {
+	return TransportInfo{
+		Kind: TransportSerial,
+		Name: transport.config.Name,
+		Baud: transport.config.Baud,
+	}
+}
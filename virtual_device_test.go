@@ -0,0 +1,759 @@
+package device
+
+import (
+	"sync"
+	"time"
+
+	_const "github.com/238Studio/child-nodes-assist/const"
+)
+
+// 已经收齐的数据报保留的时间 毫秒
+const virtualCompletedHold = 1000
+
+// VirtualHandler 虚拟下位机的应答脚本
+// 传入：收到的讯息
+// 传出：需要回复给上位机的讯息
+type VirtualHandler func(msg *SerialMessage) []*SerialMessage
+
+// VirtualDevice 运行在进程内的虚拟下位机 使用和SerialApp相同的数据帧格式
+// 它会应答初始化握手 并按照脚本或者回显应答收到的讯息 用于在没有硬件的情况下测试
+type VirtualDevice struct {
+	// 下位机一端的传输
+	transport Transport
+	// 握手时上报的功能模块
+	modules []uint32
+	// 应答脚本 moduleID->function->handler
+	handlers map[uint32]map[string]VirtualHandler
+	// 没有脚本的讯息是否原样回显
+	isEcho bool
+	// 数据帧编解码器 发布后不再修改 协商时整体替换 以便读取线程不加锁使用
+	codec *FrameCodec
+	// 握手时声明的能力 为nil时模拟不声明能力的旧固件
+	capability *deviceCapability
+	// 协商出的压缩算法
+	compressions []Compression
+	// 发往上位机的讯息的压缩配置
+	compression CompressionConfig
+	// 预共享密钥 为nil时不认证
+	authKey []byte
+	// 上位机在握手时发来的随机数
+	authNonce []byte
+	// 发出的最大序列号
+	sendSeq uint64
+	// 收到的序列号的重放窗口
+	revWindow replayWindow
+	// 认证失败或者重放被丢弃的讯息数
+	authFailures int
+	// 最近一次发出的讯息的数据帧 用于模拟重放
+	lastFrames [][]byte
+	// 发往上位机的数据帧经过的噪声
+	noise func(frame []byte)
+	// 上位机发来的数据帧是否在线路上丢失
+	loss func(frame *Frame) bool
+	// 是否协商出了逐帧确认
+	isARQ bool
+	// 接收缓冲区能容纳的数据帧数 为0时不限制 收到的数据帧同步处理
+	receiveWindow int
+	// 处理每个数据帧需要的时间 模拟处理能力有限的下位机
+	processingDelay time.Duration
+	// 接收缓冲区 收到并确认的数据帧在这里等待处理
+	rxQueue chan *RevDataBuffer
+	// 最近一次通告的接收窗口
+	advertisedWindow uint32
+	// 接收缓冲区已满被丢弃的数据帧数
+	overflows int
+	// 握手时收到的下位机编号
+	deviceID byte
+	// 是否已经完成握手
+	isInitialized bool
+	// 收到的讯息
+	received chan *SerialMessage
+	// 接收缓存 bufferID->数据帧
+	revBuffer map[uint32][]*[]byte
+	// 接收剩余帧数 bufferID->剩余帧数
+	revBufferResidue map[uint32]uint32
+	// 已经收齐的数据报的完成时间 毫秒 用于丢弃确认丢失后上位机重发的数据帧 bufferID->time mil
+	completed map[uint32]int64
+	// 发送数据报计数器
+	i uint32
+	// 控制讯息计数器
+	j uint32
+	// 互斥锁
+	mu sync.Mutex
+	// 停止通道
+	stopChannel chan struct{}
+	// 已经停止的通知
+	doneChannel chan struct{}
+}
+
+// InitVirtualDevice 初始化一个虚拟下位机
+// 传入：下位机一端的传输，握手时上报的功能模块
+// 传出：虚拟下位机
+func InitVirtualDevice(transport Transport, modules []uint32) *VirtualDevice {
+	return &VirtualDevice{
+		transport: transport,
+		modules:   modules,
+		codec:     DefaultFrameCodec(),
+		capability: &deviceCapability{
+			versions:        []byte{ProtocolVersion},
+			checksums:       []Checksum{ChecksumOddParity, ChecksumCRC16CCITT, ChecksumCRC32C},
+			framings:        []Framing{FramingFixed, FramingCOBS},
+			headers:         []HeaderProfile{HeaderFull, HeaderCompact},
+			fecs:            []FEC{FECNone, FECReedSolomon8, FECReedSolomon16},
+			compressions:    []Compression{CompressionNone, CompressionFlate},
+			arq:             true,
+			firmwareVersion: "virtual",
+		},
+		handlers:         make(map[uint32]map[string]VirtualHandler),
+		received:         make(chan *SerialMessage, 16),
+		revBuffer:        make(map[uint32][]*[]byte),
+		revBufferResidue: make(map[uint32]uint32),
+		completed:        make(map[uint32]int64),
+		j:                controlBufferIDStart - 1,
+		stopChannel:      make(chan struct{}),
+		doneChannel:      make(chan struct{}),
+	}
+}
+
+// Handle 为某个模块的某个功能注册应答脚本
+// 传入：模块ID，功能，应答脚本
+// 传出：无
+func (device *VirtualDevice) Handle(moduleID uint32, function string, handler VirtualHandler) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	_, ok := device.handlers[moduleID]
+	if !ok {
+		device.handlers[moduleID] = make(map[string]VirtualHandler)
+	}
+	device.handlers[moduleID][function] = handler
+}
+
+// SetEcho 设置没有脚本的讯息是否原样回显
+// 传入：是否回显
+// 传出：无
+func (device *VirtualDevice) SetEcho(isEcho bool) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.isEcho = isEcho
+}
+
+// SetProtocolVersions 设置握手时声明支持的协议版本 需要在Start之前调用
+// 传入：协议版本
+// 传出：无
+func (device *VirtualDevice) SetProtocolVersions(versions ...byte) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.versions = versions
+	}
+}
+
+// SetFirmwareVersion 设置握手时声明的固件版本 需要在Start之前调用
+// 传入：固件版本
+// 传出：无
+func (device *VirtualDevice) SetFirmwareVersion(version string) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.firmwareVersion = version
+	}
+}
+
+// SetChecksums 设置握手时声明支持的校验方式 需要在Start之前调用
+// 传入：校验方式
+// 传出：无
+func (device *VirtualDevice) SetChecksums(checksums ...Checksum) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.checksums = checksums
+	}
+}
+
+// SetFramings 设置握手时声明支持的分帧方式 需要在Start之前调用
+// 传入：分帧方式
+// 传出：无
+func (device *VirtualDevice) SetFramings(framings ...Framing) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.framings = framings
+	}
+}
+
+// SetMTU 设置握手时声明的数据帧长度上限 为0时不声明 需要在Start之前调用
+// 传入：数据帧长度上限
+// 传出：无
+func (device *VirtualDevice) SetMTU(mtu uint32) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.mtu = mtu
+	}
+}
+
+// MTU 获取当前使用的数据帧长度
+// 传入：无
+// 传出：数据帧长度
+func (device *VirtualDevice) MTU() uint32 {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.codec.FrameLen
+}
+
+// SetHeaders 设置握手时声明支持的帧头布局 需要在Start之前调用
+// 传入：帧头布局
+// 传出：无
+func (device *VirtualDevice) SetHeaders(headers ...HeaderProfile) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.headers = headers
+	}
+}
+
+// SetCompressions 设置握手时声明支持的压缩算法 需要在Start之前调用
+// 传入：压缩算法
+// 传出：无
+func (device *VirtualDevice) SetCompressions(compressions ...Compression) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.compressions = compressions
+	}
+}
+
+// SetCompression 设置发往上位机的讯息的压缩配置 只有协商出该算法时才会压缩
+// 传入：压缩配置
+// 传出：无
+func (device *VirtualDevice) SetCompression(config CompressionConfig) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.compression = config
+}
+
+// SetPreSharedKey 设置预共享密钥 设置后收发的每个讯息都需要认证
+// 传入：密钥（为nil时不认证）
+// 传出：无
+func (device *VirtualDevice) SetPreSharedKey(key []byte) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.authKey = key
+}
+
+// 是否配置了预共享密钥
+// 传入：无
+// 传出：是否配置
+func (device *VirtualDevice) hasAuthKey() bool {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.authKey != nil
+}
+
+// AuthFailures 获取认证失败或者重放被丢弃的讯息数
+// 传入：无
+// 传出：讯息数
+func (device *VirtualDevice) AuthFailures() int {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.authFailures
+}
+
+// ReplayLastMessage 把最近一次发出的讯息的数据帧原样再发送一次 模拟重放攻击
+// 传入：无
+// 传出：错误
+func (device *VirtualDevice) ReplayLastMessage() error {
+	device.mu.Lock()
+	frames := device.lastFrames
+	device.mu.Unlock()
+	for _, frame := range frames {
+		_, err := device.transport.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFECs 设置握手时声明支持的前向纠错方式 需要在Start之前调用
+// 传入：前向纠错方式
+// 传出：无
+func (device *VirtualDevice) SetFECs(fecs ...FEC) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.fecs = fecs
+	}
+}
+
+// SetNoise 设置发往上位机的数据帧经过的噪声 用于模拟无线串口这样不可靠的链路
+// 传入：噪声 原地修改编码后的数据帧（为nil时没有噪声）
+// 传出：无
+func (device *VirtualDevice) SetNoise(noise func(frame []byte)) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.noise = noise
+}
+
+// SetARQ 设置握手时是否声明支持逐帧确认 需要在Start之前调用
+// 传入：是否支持
+// 传出：无
+func (device *VirtualDevice) SetARQ(isARQ bool) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if device.capability != nil {
+		device.capability.arq = isARQ
+	}
+}
+
+// SetFrameLoss 设置上位机发来的数据帧在线路上的丢失 丢失的数据帧不会被确认
+// 传入：判断数据帧是否丢失（为nil时不丢失）
+// 传出：无
+func (device *VirtualDevice) SetFrameLoss(loss func(frame *Frame) bool) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.loss = loss
+}
+
+// SetReceiveWindow 设置接收缓冲区能容纳的数据帧数和处理每个数据帧需要的时间 需要在Start之前调用
+// 握手时声明接收缓冲区的大小 收到的数据帧先确认再放入缓冲区 缓冲区已满时丢弃
+// 传入：能容纳的数据帧数（为0时不限制），处理每个数据帧需要的时间
+// 传出：无
+func (device *VirtualDevice) SetReceiveWindow(slots uint16, processingDelay time.Duration) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.receiveWindow = int(slots)
+	device.processingDelay = processingDelay
+	if device.capability != nil {
+		device.capability.window = slots
+	}
+}
+
+// Overflows 获取接收缓冲区已满被丢弃的数据帧数
+// 传入：无
+// 传出：数据帧数
+func (device *VirtualDevice) Overflows() int {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.overflows
+}
+
+// SetLegacy 模拟不声明能力的旧固件 只能使用奇校验和定长分帧 需要在Start之前调用
+// 传入：无
+// 传出：无
+func (device *VirtualDevice) SetLegacy() {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.capability = nil
+}
+
+// Checksum 获取当前使用的校验方式
+// 传入：无
+// 传出：校验方式
+func (device *VirtualDevice) Checksum() Checksum {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.codec.Checksum
+}
+
+// Framing 获取当前使用的分帧方式
+// 传入：无
+// 传出：分帧方式
+func (device *VirtualDevice) Framing() Framing {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.codec.Framing
+}
+
+// Header 获取当前使用的帧头布局
+// 传入：无
+// 传出：帧头布局
+func (device *VirtualDevice) Header() HeaderProfile {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.codec.Header
+}
+
+// DeviceID 获取握手时收到的下位机编号
+// 传入：无
+// 传出：下位机编号，是否已经完成握手
+func (device *VirtualDevice) DeviceID() (byte, bool) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.deviceID, device.isInitialized
+}
+
+// Received 获取收到的讯息 也就是重组并解析消息信封后的讯息
+// 传入：无
+// 传出：讯息通道
+func (device *VirtualDevice) Received() <-chan *SerialMessage {
+	return device.received
+}
+
+// Start 开始运行虚拟下位机
+// 传入：无
+// 传出：无
+func (device *VirtualDevice) Start() {
+	go device.run()
+}
+
+// Stop 停止虚拟下位机 关闭其传输并等待其退出
+// 传入：无
+// 传出：无
+func (device *VirtualDevice) Stop() {
+	close(device.stopChannel)
+	_ = device.transport.Close()
+	<-device.doneChannel
+}
+
+// SendMessage 主动向上位机发送一条讯息
+// 传入：讯息
+// 传出：错误
+func (device *VirtualDevice) SendMessage(msg *SerialMessage) error {
+	return device.sendMessage(msg, false)
+}
+
+// 向上位机发送一条讯息 控制讯息使用和普通数据报不重叠的编号
+// 传入：讯息，是否是控制讯息
+// 传出：错误
+func (device *VirtualDevice) sendMessage(msg *SerialMessage, isControl bool) error {
+	device.mu.Lock()
+	codec := *device.codec
+	var bufferID uint32
+	if isControl {
+		// 紧凑帧头的数据报编号只有16位
+		if device.j == 0xFFFF {
+			device.j = controlBufferIDStart - 1
+		}
+		device.j++
+		bufferID = device.j
+	} else {
+		bufferID = device.i
+		device.i = (device.i + 1) % controlBufferIDStart
+	}
+	compression := CompressionNone
+	if device.compression.Algorithm != CompressionNone && len(msg.Data) >= device.compression.Threshold {
+		for _, c := range device.compressions {
+			if c == device.compression.Algorithm {
+				compression = c
+			}
+		}
+	}
+	authKey := device.authKey
+	nonce := device.authNonce
+	device.sendSeq++
+	seq := device.sendSeq
+	device.mu.Unlock()
+	data, _, err := encodeSerialMessage(msg, compression)
+	if err != nil {
+		return err
+	}
+	if authKey != nil {
+		data = sealEnvelope(authKey, nonce, authToHost, seq, data)
+	}
+	frames, err := codec.encodeEnvelope(data, bufferID)
+	if err != nil {
+		return err
+	}
+	device.mu.Lock()
+	device.lastFrames = frames
+	noise := device.noise
+	device.mu.Unlock()
+	for _, frame := range frames {
+		if noise != nil {
+			frame = append([]byte{}, frame...)
+			noise(frame)
+		}
+		_, err = device.transport.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 虚拟下位机的主循环 读取传输 应答握手并重组数据帧
+// 传入：无
+// 传出：无
+func (device *VirtualDevice) run() {
+	defer close(device.doneChannel)
+	device.mu.Lock()
+	if device.receiveWindow > 0 {
+		device.rxQueue = make(chan *RevDataBuffer, device.receiveWindow)
+		workerDone := make(chan struct{})
+		go device.process(workerDone)
+		defer func() { <-workerDone }()
+	}
+	device.mu.Unlock()
+	listenBuffer := make([]byte, _const.PortLen)
+	receiver := initFrameReceiver(device.currentCodec(), nil)
+	for {
+		select {
+		case <-device.stopChannel:
+			return
+		default:
+		}
+		read, err := device.transport.Read(listenBuffer)
+		if err != nil {
+			return
+		}
+		data := listenBuffer[:read]
+		// 握手 第一个字节是上位机分配的下位机编号 配置了密钥时之后是握手随机数
+		if _, isInitialized := device.DeviceID(); !isInitialized && len(data) > 0 {
+			handshakeLen := 1
+			if device.hasAuthKey() {
+				handshakeLen += authNonceLen
+			}
+			handshakeLen = min(handshakeLen, len(data))
+			device.answerInit(data[0], data[1:handshakeLen])
+			data = data[handshakeLen:]
+		}
+		// 协商之后使用新的编解码器
+		receiver.codec = device.currentCodec()
+		receiver.push(data)
+		for {
+			frame, ok, err := receiver.next()
+			if !ok {
+				break
+			}
+			if err != nil {
+				continue
+			}
+			rev, err := InitRevDataBuffer(frame)
+			if err != nil {
+				continue
+			}
+			device.mu.Lock()
+			loss := device.loss
+			isARQ := device.isARQ
+			device.mu.Unlock()
+			if loss != nil && loss(frame) {
+				continue
+			}
+			if device.rxQueue == nil {
+				if device.putDataFrame(rev) && isARQ && !isControlBufferID(frame.BufferID) {
+					device.sendFrameAck(frame)
+				}
+				continue
+			}
+			select {
+			case device.rxQueue <- rev:
+			default:
+				device.mu.Lock()
+				device.overflows++
+				device.mu.Unlock()
+				continue
+			}
+			if isARQ && !isControlBufferID(frame.BufferID) {
+				device.sendFrameAck(frame)
+			}
+		}
+	}
+}
+
+// 处理接收缓冲区中的数据帧 接收窗口从0恢复时主动通告
+// 传入：退出时的通知
+// 传出：无
+func (device *VirtualDevice) process(done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-device.stopChannel:
+			return
+		case rev := <-device.rxQueue:
+			time.Sleep(device.processingDelay)
+			device.putDataFrame(rev)
+			device.mu.Lock()
+			isUpdate := device.isARQ && device.advertisedWindow == 0
+			device.mu.Unlock()
+			if isUpdate {
+				device.sendFrameAck(nil)
+			}
+		}
+	}
+}
+
+// 确认上位机发来的数据帧 同时通告接收窗口
+// 传入：数据帧（为nil时只通告接收窗口）
+// 传出：无
+func (device *VirtualDevice) sendFrameAck(frame *Frame) {
+	device.mu.Lock()
+	window := unlimitedWindow
+	if device.rxQueue != nil {
+		window = uint32(device.receiveWindow - len(device.rxQueue))
+	}
+	device.advertisedWindow = window
+	device.mu.Unlock()
+	frames := make([]*Frame, 0, 1)
+	if frame != nil {
+		frames = append(frames, frame)
+	}
+	_ = device.sendMessage(&SerialMessage{
+		TargetModuleID: _const.FeedbackModule,
+		TargetFunction: FrameAck,
+		Data:           encodeFrameAck(window, frames...),
+	}, true)
+}
+
+// 应答初始化握手 上报下位机编号和功能模块
+// 传入：下位机编号
+// 传出：无
+func (device *VirtualDevice) answerInit(deviceID byte, nonce []byte) {
+	device.mu.Lock()
+	device.deviceID = deviceID
+	device.isInitialized = true
+	// 重新握手后序列号重新开始 认证使用新的握手随机数
+	device.authNonce = append([]byte{}, nonce...)
+	device.sendSeq = 0
+	device.revWindow = replayWindow{}
+	// 逐帧确认要等新的协商结果
+	device.isARQ = false
+	data := []byte{deviceID}
+	for _, moduleID := range device.modules {
+		data = append(data, Uint32ToBytes(moduleID)...)
+	}
+	capability := device.capability
+	device.mu.Unlock()
+	if capability != nil {
+		_ = device.SendMessage(&SerialMessage{
+			TargetModuleID: _const.InitModule,
+			TargetFunction: InitCapability,
+			Data:           encodeCapability(deviceID, capability),
+		})
+	}
+	_ = device.SendMessage(&SerialMessage{
+		TargetModuleID: _const.InitModule,
+		TargetFunction: _const.InitData,
+		Data:           data,
+	})
+}
+
+// 处理上位机告知的协商结果 之后收发都使用选定的参数
+// 传入：协商结果
+// 传出：无
+func (device *VirtualDevice) accept(data []byte) {
+	deviceID, accepted, err := parseCapability(data)
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if err != nil || deviceID != device.deviceID {
+		return
+	}
+	// 读取线程可能正在使用旧的编解码器 修改副本后整体替换
+	codec := *device.codec
+	if len(accepted.checksums) == 1 {
+		codec.Checksum = accepted.checksums[0]
+	}
+	if len(accepted.framings) == 1 {
+		codec.Framing = accepted.framings[0]
+	}
+	if len(accepted.headers) == 1 {
+		codec.Header = accepted.headers[0]
+	}
+	if len(accepted.fecs) == 1 {
+		codec.FEC = accepted.fecs[0]
+	}
+	if accepted.mtu >= minFrameLen {
+		codec.FrameLen = accepted.mtu
+	}
+	device.codec = &codec
+	device.compressions = accepted.compressions
+	device.isARQ = accepted.arq
+	device.advertisedWindow = uint32(device.receiveWindow)
+}
+
+// 放入收到的数据帧 收齐后处理该数据报 刚刚收齐的数据报重复到达的数据帧直接丢弃
+// 传入：数据帧
+// 传出：是否放入了接收缓存（包括重复收到的）
+func (device *VirtualDevice) putDataFrame(frame *RevDataBuffer) bool {
+	nowTime := time.Now().UnixMilli()
+	for bufferID, completedTime := range device.completed {
+		if nowTime-completedTime > virtualCompletedHold {
+			delete(device.completed, bufferID)
+		}
+	}
+	if _, ok := device.completed[frame.bufferID]; ok {
+		return true
+	}
+	frames, ok := device.revBuffer[frame.bufferID]
+	if ok && uint32(len(frames)) != frame.frameNum {
+		return false
+	}
+	if !ok {
+		frames = make([]*[]byte, frame.frameNum)
+		device.revBuffer[frame.bufferID] = frames
+		device.revBufferResidue[frame.bufferID] = frame.frameNum
+	}
+	if frames[frame.frameID] != nil {
+		return true
+	}
+	frames[frame.frameID] = frame.data
+	device.revBufferResidue[frame.bufferID]--
+	if device.revBufferResidue[frame.bufferID] != 0 {
+		return true
+	}
+	data := make([]byte, 0)
+	for _, d := range frames {
+		data = append(data, *d...)
+	}
+	delete(device.revBuffer, frame.bufferID)
+	delete(device.revBufferResidue, frame.bufferID)
+	device.completed[frame.bufferID] = nowTime
+	device.handleData(data)
+	return true
+}
+
+// 获取当前的编解码器 返回的编解码器不会再被修改
+// 传入：无
+// 传出：编解码器
+func (device *VirtualDevice) currentCodec() *FrameCodec {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	return device.codec
+}
+
+// 处理收到的完整数据报 记录下来并按照脚本应答
+// 传入：数据报
+// 传出：无
+func (device *VirtualDevice) handleData(data []byte) {
+	device.mu.Lock()
+	if device.authKey != nil {
+		opened, err := openEnvelope(device.authKey, device.authNonce, authToDevice, &device.revWindow, data)
+		if err != nil {
+			device.authFailures++
+			device.mu.Unlock()
+			return
+		}
+		data = opened
+	}
+	device.mu.Unlock()
+	msg, err := ParseDataToSerialMessage(&data)
+	if err != nil {
+		return
+	}
+	// 协商结果由虚拟下位机自己处理
+	if msg.TargetModuleID == _const.InitModule && msg.TargetFunction == InitAccept {
+		device.accept(msg.Data)
+		return
+	}
+	// 虚拟下位机发出的讯息不等待确认
+	if msg.TargetModuleID == _const.FeedbackModule && msg.TargetFunction == FrameAck {
+		return
+	}
+	select {
+	case device.received <- msg:
+	default:
+	}
+	device.mu.Lock()
+	handler, ok := device.handlers[msg.TargetModuleID][msg.TargetFunction]
+	isEcho := device.isEcho
+	device.mu.Unlock()
+	replies := make([]*SerialMessage, 0)
+	if ok {
+		replies = handler(msg)
+	} else if isEcho {
+		replies = append(replies, msg)
+	}
+	for _, reply := range replies {
+		_ = device.SendMessage(reply)
+	}
+}
@@ -0,0 +1,51 @@
+package device
+
+/*
+ 逐帧确认的下位机可以在握手时声明其接收缓冲区能容纳的数据帧数 上位机据此对发往该下位机的数据帧做流量控制
+ 每个确认都带有接收窗口 也就是接收方此时还能容纳的未确认数据帧数 已经确认但还没有处理完的数据帧不在其中
+ 发送方已经发出还没有被确认的数据帧数不会超过最近一次通告的接收窗口 超时重发的数据帧已经计算在内 不受窗口限制
+ 接收窗口为0时发送方停止发送新的数据帧 等待接收方处理完数据帧后主动通告的窗口
+ 如果这个通告丢失 发送方在确认超时后发送一帧作为探测 接收方对探测的确认会带来新的窗口
+ 没有声明接收窗口的下位机不做流量控制 上位机的接收缓存只受内存限制 通告的窗口总是unlimitedWindow
+*/
+
+// 不限制的接收窗口
+const unlimitedWindow uint32 = 0xFFFF
+
+// 按协商结果重置发送窗口
+// 传入：链路参数
+// 传出：无
+func (device *SerialDevice) resetSendWindow(profile *Profile) {
+	device.sendWindow = unlimitedWindow
+	if profile.ARQ && profile.Window != 0 {
+		device.sendWindow = uint32(profile.Window)
+	}
+	device.windowUpdatedAt = 0
+}
+
+// 更新发送窗口 没有声明接收窗口的下位机不做流量控制
+// 传入：接收方通告的窗口，当前时间 毫秒
+// 传出：无
+func (device *SerialDevice) updateSendWindow(window uint32, nowTime int64) {
+	if device.profile == nil || device.profile.Window == 0 {
+		return
+	}
+	device.sendWindow = window
+	device.windowUpdatedAt = nowTime
+}
+
+// 是否可以发送一个新的数据帧
+// 窗口为0并且没有在途的数据帧时 距离上一次通告超过确认超时后允许发送一帧作为探测
+// 传入：在途的数据帧数，当前时间 毫秒，确认超时 毫秒
+// 传出：是否可以发送
+func (device *SerialDevice) canSendNewFrame(inFlight int, nowTime int64, ackTimeout int64) bool {
+	if uint32(inFlight) < device.sendWindow {
+		return true
+	}
+	if device.sendWindow == 0 && inFlight == 0 && nowTime-device.windowUpdatedAt > ackTimeout {
+		// 探测之后重新等待一个确认超时
+		device.windowUpdatedAt = nowTime
+		return true
+	}
+	return false
+}